@@ -0,0 +1,287 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Admin functions for inspecting and managing individual games.  Like dump and reset, these are POST
+// requests with JSON bodies and require the admin role.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Summary of one game as returned by the list function
+type GameSummary struct {
+	GameToken    string `json:"gameToken"`
+	NumPlayers   int    `json:"numPlayers"`
+	Players      int    `json:"players"`   // Number of players that have joined
+	Connected    int    `json:"connected"` // Number of players with a live connection
+	IdleCount    int    `json:"idleCount"`
+	EnforceTurns bool   `json:"enforceTurns"`
+	Phase        string `json:"phase"`
+	Leader       uint32 `json:"leader"`
+}
+
+// Errors reported by registry operations on a single game or player
+var (
+	errNoSuchGame   = errors.New("no such game")
+	errNoSuchPlayer = errors.New("no such player")
+)
+
+// Register the handler for an admin function.  The handler is called with the decoded request body
+// only when the request is valid and comes from an administrator.
+func handleAdmin(mux *http.ServeMux, path string, handler func(w http.ResponseWriter, body map[string]interface{})) {
+	mux.Handle(path, EnsureValidToken()(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if body := screenRequest(w, r); body != nil {
+				if isAdmin(w, r) {
+					handler(w, *body)
+				}
+			}
+		}),
+	))
+}
+
+// Set up the handlers for the admin functions on individual games
+func setupAdminHandlers(mux *http.ServeMux) {
+	handleAdmin(mux, pathListGames, func(w http.ResponseWriter, body map[string]interface{}) {
+		writeJSON(w, registry.summaries())
+	})
+	handleAdmin(mux, pathGetGame, func(w http.ResponseWriter, body map[string]interface{}) {
+		gameToken, ok := getGameTokenField(w, body)
+		if !ok {
+			return
+		}
+		encoded, err := registry.encodeGame(gameToken)
+		if err != nil {
+			indicateError(http.StatusNotFound, clientMessage(err), w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(encoded, byte('\n')))
+	})
+	handleAdmin(mux, pathDeleteGame, func(w http.ResponseWriter, body map[string]interface{}) {
+		gameToken, ok := getGameTokenField(w, body)
+		if !ok {
+			return
+		}
+		if !registry.endGame(gameToken, phaseAbandoned) {
+			indicateError(http.StatusNotFound, clientMessage(errNoSuchGame), w)
+			return
+		}
+		slog.Info("Admin deleted game", logKeyGameToken, gameToken)
+		writeJSON(w, map[string]string{"deleted": gameToken})
+	})
+	handleAdmin(mux, pathKickPlayer, func(w http.ResponseWriter, body map[string]interface{}) {
+		gameToken, ok := getGameTokenField(w, body)
+		if !ok {
+			return
+		}
+		playerOrder, ok := getNumberField(body, "player")
+		if !ok || playerOrder <= 0 {
+			indicateError(http.StatusBadRequest, "Missing or invalid player", w)
+			return
+		}
+		if err := registry.kickPlayer(gameToken, uint32(playerOrder)); err != nil {
+			indicateError(http.StatusNotFound, clientMessage(err), w)
+			return
+		}
+		slog.Info("Admin kicked player", logKeyGameToken, gameToken, "order", playerOrder)
+		writeJSON(w, map[string]interface{}{"kicked": playerOrder, "gameToken": gameToken})
+	})
+	handleAdmin(mux, pathSetNumPlayers, func(w http.ResponseWriter, body map[string]interface{}) {
+		gameToken, ok := getGameTokenField(w, body)
+		if !ok {
+			return
+		}
+		numPlayers, ok := getNumberField(body, "numPlayers")
+		if !ok || numPlayers < 0 || numPlayers > maxNumPlayers {
+			indicateError(http.StatusBadRequest, "Missing or invalid numPlayers", w)
+			return
+		}
+		if err := registry.setNumPlayers(gameToken, numPlayers); err != nil {
+			if joinErr, ok := err.(*joinError); ok {
+				indicateCodedError(joinErr.status, joinErr.code, joinErr.msg, w)
+			} else {
+				indicateError(http.StatusNotFound, clientMessage(err), w)
+			}
+			return
+		}
+		slog.Info("Admin set number of players", logKeyGameToken, gameToken, "numPlayers", numPlayers)
+		writeJSON(w, map[string]interface{}{"numPlayers": numPlayers, "gameToken": gameToken})
+	})
+}
+
+// Get the game token from a request body, indicating an error if missing
+func getGameTokenField(w http.ResponseWriter, body map[string]interface{}) (string, bool) {
+	gameToken, _ := body["gameToken"].(string)
+	if gameToken == "" {
+		indicateError(http.StatusBadRequest, "Missing gameToken", w)
+		return "", false
+	}
+	return gameToken, true
+}
+
+// Get an integer from a request body.  JSON numbers decode as float64.
+func getNumberField(body map[string]interface{}, key string) (int, bool) {
+	number, ok := body[key].(float64)
+	if !ok || number != float64(int(number)) {
+		return 0, false
+	}
+	return int(number), true
+}
+
+// Write a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		indicateError(http.StatusInternalServerError, err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(encoded, byte('\n')))
+}
+
+// Summarize all the games, sorted by game token
+func (r *GameRegistry) summaries() []GameSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ans := []GameSummary{}
+	for gameToken, game := range r.games {
+		summary := GameSummary{GameToken: gameToken, NumPlayers: game.NumPlayers, Players: len(game.Players),
+			IdleCount: game.IdleCount, EnforceTurns: game.EnforceTurns, Phase: game.Phase, Leader: game.Leader}
+		for _, player := range game.Players {
+			if isConnected(player) {
+				summary.Connected++
+			}
+		}
+		ans = append(ans, summary)
+	}
+	slices.SortFunc(ans, func(a, b GameSummary) int {
+		return strings.Compare(a.GameToken, b.GameToken)
+	})
+	return ans
+}
+
+// Encode one game as JSON
+func (r *GameRegistry) encodeGame(gameToken string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	game := r.games[gameToken]
+	if game == nil {
+		return nil, errNoSuchGame
+	}
+	return json.MarshalIndent(game, "", "  ")
+}
+
+// Remove a player from a game, destroying its client and sending the new player list to the others.  A
+// connected player's client reports it lost when destroyed; otherwise, unless it was already lost, that is
+// done here.  If the player was the leader, a new one is elected, and if it was the active player, the turn
+// passes to the next player.
+func (r *GameRegistry) kickPlayer(gameToken string, playerOrder uint32) error {
+	r.mu.Lock()
+	game := r.games[gameToken]
+	if game == nil {
+		r.mu.Unlock()
+		return errNoSuchGame
+	}
+	player := game.Players[playerOrder]
+	if player == nil {
+		r.mu.Unlock()
+		return errNoSuchPlayer
+	}
+	client := player.Client
+	reportLost := !isConnected(player) && player.State != playerLost
+	player.State = playerLost
+	delete(game.Players, playerOrder)
+	logStoreError(store.RecordRemovePlayer(gameToken, playerOrder))
+	playerList := makePlayerList(game)
+	var leader uint32
+	elected := playerOrder == game.Leader
+	if elected {
+		leader = electLeader(game)
+	}
+	var active uint32
+	if game.EnforceTurns && game.ActivePlayer == playerOrder && len(game.Players) > 0 {
+		active = nextPlayer(game, playerOrder)
+		game.ActivePlayer = active
+		logStoreError(store.RecordTurn(gameToken, true, active))
+	}
+	r.mu.Unlock()
+	if client != nil {
+		client.Destroy()
+	}
+	if reportLost {
+		game.Hub.broadcastMessage(lostPlayerType, []byte(player.Token))
+	}
+	game.Hub.broadcastMessage(playerListType, []byte(playerList))
+	if elected {
+		game.Hub.announceLeader(leader)
+	}
+	if active != 0 {
+		game.Hub.broadcastMessage(turnType, []byte(strconv.FormatUint(uint64(active), 10)))
+	}
+	return nil
+}
+
+// Change the expected number of players of a game and send the new player list to the players.  A
+// number that leaves out players who have already joined is rejected with a joinError.
+func (r *GameRegistry) setNumPlayers(gameToken string, numPlayers int) error {
+	r.mu.Lock()
+	game := r.games[gameToken]
+	if game == nil {
+		r.mu.Unlock()
+		return errNoSuchGame
+	}
+	if err := validateNumPlayers(game, numPlayers); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	game.NumPlayers = numPlayers
+	logStoreError(store.RecordNumPlayers(gameToken, numPlayers))
+	playerList := makePlayerList(game)
+	r.mu.Unlock()
+	game.Hub.broadcastMessage(playerListType, []byte(playerList))
+	r.startIfComplete(game)
+	return nil
+}
+
+// Check that the players who have joined a game fit within a new number of players (0 meaning unknown),
+// by the rules of validateJoin.  The registry lock must be held.
+func validateNumPlayers(game *Game, numPlayers int) error {
+	if numPlayers == 0 {
+		return nil
+	}
+	if len(game.Players) > numPlayers {
+		return &joinError{http.StatusConflict, errCodeNumPlayersMismatch,
+			fmt.Sprintf("The game already has %d players", len(game.Players))}
+	}
+	for order := range game.Players {
+		if order > uint32(numPlayers) {
+			return &joinError{http.StatusBadRequest, errCodeInvalidOrder,
+				fmt.Sprintf("Player %d exceeds the number of players", order)}
+		}
+	}
+	return nil
+}
@@ -16,13 +16,24 @@
  */
 
 // The authorizaiton module for the anyCards game.  Mostly boilerplate from auth0.com.
+//
+// The token validation backend is selected by AUTH_MODE:
+//   - auth0 (the default) validates RS256 tokens against the JWKS published by the Auth0 tenant
+//     AUTH0_DOMAIN, with audience AUTH0_AUDIENCE.
+//   - jwks-file validates RS256 tokens against a static JWKS read from the file AUTH_JWKS_FILE.
+//   - hs256 validates HS256 tokens signed with the shared secret AUTH_HS256_SECRET.
+//
+// The latter two allow the server to run without access to Auth0 (offline development and tests).  They
+// use AUTH_ISSUER and AUTH_AUDIENCE for the expected issuer and audience (default "unigame-local").
 
 package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -31,8 +42,31 @@ import (
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"gopkg.in/go-jose/go-jose.v2"
+)
+
+// Token validation backends
+const (
+	authModeAuth0    = "auth0"
+	authModeJWKSFile = "jwks-file"
+	authModeHS256    = "hs256"
 )
 
+// Issuer and audience used by the non-Auth0 backends when not otherwise specified
+const defaultLocalIssuerAndAudience = "unigame-local"
+
+// Settings for token validation
+type AuthConfig struct {
+	Mode     string
+	Issuer   string
+	Audience string
+	JWKSFile string // For jwks-file mode
+	Secret   string // For hs256 mode
+}
+
+// The validator used by EnsureValidToken, set up by setupTokenValidation
+var tokenValidator *validator.Validator
+
 // CustomClaims contains custom data we want from the token.
 type CustomClaims struct {
 	Permissions []string `json:"permissions"`
@@ -44,21 +78,48 @@ func (c CustomClaims) Validate(ctx context.Context) error {
 	return nil
 }
 
-// EnsureValidToken is a middleware that will check the validity of our JWT.
-func EnsureValidToken() func(next http.Handler) http.Handler {
-	issuerURL, err := url.Parse("https://" + os.Getenv("AUTH0_DOMAIN") + "/")
-	if err != nil {
-		fmt.Printf("Failed to parse the issuer url: %v\n", err)
-		os.Exit(1) // Terminal since this URL is effectively built in
+// Read the token validation settings from the environment, reporting any that are missing
+func loadAuthConfig() (*AuthConfig, error) {
+	config := &AuthConfig{Mode: os.Getenv("AUTH_MODE")}
+	switch config.Mode {
+	case "", authModeAuth0:
+		config.Mode = authModeAuth0
+		domain := os.Getenv("AUTH0_DOMAIN")
+		config.Audience = os.Getenv("AUTH0_AUDIENCE")
+		if domain == "" || config.Audience == "" {
+			return nil, errors.New("AUTH0_DOMAIN and AUTH0_AUDIENCE must both be set")
+		}
+		config.Issuer = "https://" + domain + "/"
+		return config, nil
+	case authModeJWKSFile:
+		config.JWKSFile = os.Getenv("AUTH_JWKS_FILE")
+		if config.JWKSFile == "" {
+			return nil, errors.New("AUTH_JWKS_FILE must be set")
+		}
+	case authModeHS256:
+		config.Secret = os.Getenv("AUTH_HS256_SECRET")
+		if config.Secret == "" {
+			return nil, errors.New("AUTH_HS256_SECRET must be set")
+		}
+	default:
+		return nil, fmt.Errorf("unknown AUTH_MODE %q", config.Mode)
 	}
+	config.Issuer = getenvDefault("AUTH_ISSUER", defaultLocalIssuerAndAudience)
+	config.Audience = getenvDefault("AUTH_AUDIENCE", defaultLocalIssuerAndAudience)
+	return config, nil
+}
 
-	provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
-
-	jwtValidator, err := validator.New(
-		provider.KeyFunc,
-		validator.RS256,
-		issuerURL.String(),
-		[]string{os.Getenv("AUTH0_AUDIENCE")},
+// Set up the validator used by EnsureValidToken
+func setupTokenValidation(config *AuthConfig) error {
+	keyFunc, algorithm, err := newKeyFunc(config)
+	if err != nil {
+		return err
+	}
+	tokenValidator, err = validator.New(
+		keyFunc,
+		algorithm,
+		config.Issuer,
+		[]string{config.Audience},
 		validator.WithCustomClaims(
 			func() validator.CustomClaims {
 				return &CustomClaims{}
@@ -67,12 +128,50 @@ func EnsureValidToken() func(next http.Handler) http.Handler {
 		validator.WithAllowedClockSkew(time.Minute),
 	)
 	if err != nil {
-		fmt.Println("Failed to set up the jwt validator")
-		os.Exit(1) // Terminal since this is built-in auth0 infrastructure
+		return fmt.Errorf("failed to set up the jwt validator: %w", err)
+	}
+	if config.Mode != authModeAuth0 {
+		slog.Warn("Using local token validation; not for production use", "mode", config.Mode)
+	}
+	return nil
+}
+
+// Make the function that supplies the key(s) for validating tokens, and determine the signature algorithm
+func newKeyFunc(config *AuthConfig) (func(context.Context) (interface{}, error), validator.SignatureAlgorithm,
+	error) {
+	switch config.Mode {
+	case authModeJWKSFile:
+		encoded, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, "", err
+		}
+		keySet := new(jose.JSONWebKeySet)
+		if err := json.Unmarshal(encoded, keySet); err != nil {
+			return nil, "", fmt.Errorf("could not decode jwks file: %w", err)
+		}
+		return func(context.Context) (interface{}, error) {
+			return keySet, nil
+		}, validator.RS256, nil
+	case authModeHS256:
+		secret := []byte(config.Secret)
+		return func(context.Context) (interface{}, error) {
+			return secret, nil
+		}, validator.HS256, nil
+	default:
+		issuerURL, err := url.Parse(config.Issuer)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse the issuer url: %w", err)
+		}
+		provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
+		return provider.KeyFunc, validator.RS256, nil
 	}
+}
 
+// EnsureValidToken is a middleware that will check the validity of our JWT.
+func EnsureValidToken() func(next http.Handler) http.Handler {
 	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
-		fmt.Printf("Encountered error while validating JWT: %v\n", err)
+		requestLogger(r).Warn("Encountered error while validating JWT", "error", err)
+		jwtFailures.Add(1)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -80,7 +179,7 @@ func EnsureValidToken() func(next http.Handler) http.Handler {
 	}
 
 	middleware := jwtmiddleware.New(
-		jwtValidator.ValidateToken,
+		tokenValidator.ValidateToken,
 		jwtmiddleware.WithErrorHandler(errorHandler),
 	)
 
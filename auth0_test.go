@@ -0,0 +1,118 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Tests of token validation with a static JWKS file
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"gopkg.in/go-jose/go-jose.v2"
+	"gopkg.in/go-jose/go-jose.v2/jwt"
+)
+
+// Switch token validation to jwks-file mode with a file holding the public half of `key`, restoring the
+// test configuration when the test ends
+func useJWKSFile(t *testing.T, key *rsa.PrivateKey, keyID string) *AuthConfig {
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: keyID, Algorithm: string(jose.RS256), Use: "sig"},
+	}}
+	encoded, err := json.Marshal(keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, encoded, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	authConfig := &AuthConfig{Mode: authModeJWKSFile, Issuer: defaultLocalIssuerAndAudience,
+		Audience: defaultLocalIssuerAndAudience, JWKSFile: path}
+	t.Cleanup(func() {
+		if err := setupTokenValidation(testAuthConfig); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := setupTokenValidation(authConfig); err != nil {
+		t.Fatal(err)
+	}
+	return authConfig
+}
+
+// Sign an RS256 token for a subject with the given key, naming the key by `keyID`
+func signRS256(t *testing.T, authConfig *AuthConfig, key *rsa.PrivateKey, keyID string, subject string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   authConfig.Issuer,
+		Subject:  subject,
+		Audience: jwt.Audience{authConfig.Audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(CustomClaims{}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJWKSFileToken(t *testing.T) {
+	key := newRSAKey(t)
+	authConfig := useJWKSFile(t, key, "test-key")
+	token := signRS256(t, authConfig, key, "test-key", "alice")
+	validated, err := tokenValidator.ValidateToken(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := validated.(*validator.ValidatedClaims).RegisteredClaims.Subject; subject != "alice" {
+		t.Fatalf("expected subject alice, got %q", subject)
+	}
+}
+
+func TestJWKSFileRejectsUnknownKey(t *testing.T) {
+	key := newRSAKey(t)
+	authConfig := useJWKSFile(t, key, "test-key")
+	if _, err := tokenValidator.ValidateToken(context.Background(),
+		signRS256(t, authConfig, key, "other-key", "alice")); err == nil {
+		t.Fatal("token with an unknown key id accepted")
+	}
+	if _, err := tokenValidator.ValidateToken(context.Background(),
+		signRS256(t, authConfig, newRSAKey(t), "test-key", "alice")); err == nil {
+		t.Fatal("token signed by a different key accepted")
+	}
+}
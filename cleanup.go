@@ -20,66 +20,111 @@
 package main
 
 import (
-	"fmt"
-	"time"
+	"log/slog"
 )
 
 // Cleanup function, expected to be invoked at regular intervals.
-// The constant `playerTimeout` expresses how many times a player can be found
+// The configured `PlayerTimeout` determines how many times a player can be found
 // unresponsive by this function before it is removed.   The player idle count is
 // zeroed everytime the player app responds with a pong to a websocket ping from the server.
-// So, the playerTimeout should be a small multiple of the pong wait time.
-// The constant `gameFormationTimeout` expresses how many times a game may be found
+// So, the PlayerTimeout should be a small multiple of the pong wait time.
+// The configured `GameFormationTimeout` determines how many times a game may be found
 // incomplete (number of players unknown or not as many players as needed).  Once a game
 // is complete, its idle count is no longer used.  It will be deleted when it has no more
 // players.
-func cleanup() {
+// Deleted games are abandoned (see lifecycle.go).  Disconnected players whose reconnect grace has
+// expired are reported lost (see reconnect.go).  If the leader of a game is lost or deleted, a new one
+// is elected (see leader.go).
+// The registry is locked while the games are examined, but the clients of deleted players are
+// destroyed, and deleted games ended, only after the lock is released.
+func (r *GameRegistry) cleanup() {
+	var doomed []*Client
+	var deleted []*Game
+	lost := make(map[*Player]*Hub)
+	leaders := make(map[*Game]uint32)
+	defer func() {
+		for _, client := range doomed {
+			client.Destroy()
+		}
+		for player, hub := range lost {
+			hub.broadcastMessage(lostPlayerType, []byte(player.Token))
+		}
+		for game, leader := range leaders {
+			game.Hub.announceLeader(leader)
+		}
+		for _, game := range deleted {
+			game.Hub.end(phaseAbandoned)
+		}
+	}()
+	playerTimeout := config.playerIdleLimit()
+	gameFormationTimeout := config.gameFormationIdleLimit()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cleanupCounter++
+	r.pruneSecretFailures()
 	// Note: deletion from a map in the scope of a 'range' loop is said to be safe:
 	// https://stackoverflow.com/questions/23229975/is-it-safe-to-remove-selected-keys-from-map-within-a-range-loop
-	for gameToken, game := range games {
+	for gameToken, game := range r.games {
 		// Time out any games that have taken too long to find enough players
 		if game.NumPlayers == 0 || len(game.Players) < game.NumPlayers {
 			// Game not yet fully assembled, so subject to time limit
 			game.IdleCount++
 			if game.IdleCount > gameFormationTimeout {
-				fmt.Printf("cleanup deleting incomplete game '%s' that has passed its time limit\n", gameToken)
-				for _, player := range game.Players {
-					if player.Client != nil {
-						player.Client.Destroy()
-					}
-				}
-				delete(games, gameToken)
+				slog.Info("cleanup deleting incomplete game that has passed its time limit", logKeyGameToken, gameToken)
+				game.Phase = phaseAbandoned
+				delete(r.games, gameToken)
+				logStoreError(store.RecordRemoveGame(gameToken))
+				cleanupDeletions[reasonFormationTimeout].Add(1)
+				deleted = append(deleted, game)
 				continue
 			}
 		} else {
 			game.IdleCount = 0
 		}
-		// Timeout any players that have been idle too long.  Delete the game if it has no player.
+		// Timeout any players that have been idle too long, electing a new leader if the leader is among
+		// them.  Delete the game if it has no player.
 		for playerOrder, player := range game.Players {
+			if graceExpired(game, player) {
+				lost[player] = game.Hub
+				if playerOrder == game.Leader {
+					leaders[game] = electLeader(game)
+				}
+			}
 			player.IdleCount++
 			if player.IdleCount > playerTimeout {
-				fmt.Printf("cleanup deleting player %d from game %s\n", playerOrder, gameToken)
+				slog.Info("cleanup deleting idle player", logKeyGameToken, gameToken, logKeyPlayer, player.Token)
 				if player.Client != nil {
-					player.Client.Destroy()
+					doomed = append(doomed, player.Client)
+				}
+				if player.State == playerDisconnected {
+					// Not yet reported lost, and its client is already gone
+					player.State = playerLost
+					lost[player] = game.Hub
 				}
 				delete(game.Players, playerOrder)
+				cleanupDeletions[reasonIdlePlayer].Add(1)
+				logStoreError(store.RecordRemovePlayer(gameToken, playerOrder))
+				if playerOrder == game.Leader {
+					leaders[game] = electLeader(game)
+				}
 			}
 		}
-		if len(game.Players) == 0 {
-			fmt.Printf("cleanup discarding game %s because it no longer has any players\n", gameToken)
-			delete(games, gameToken)
+		if len(game.Players) == 0 && !game.Reserved {
+			slog.Info("cleanup discarding game because it no longer has any players", logKeyGameToken, gameToken)
+			game.Phase = phaseAbandoned
+			delete(r.games, gameToken)
+			logStoreError(store.RecordRemoveGame(gameToken))
+			cleanupDeletions[reasonEmptyGame].Add(1)
+			deleted = append(deleted, game)
 		}
 	}
 }
 
-// Start a ticker to do cleanup every 'cleanupPeriod' seconds
-func startCleanupTicker() {
-	ticker := time.NewTicker(cleanupPeriod * time.Second)
-	go func() {
-		for {
-			<-ticker.C
-			cleanupCounter++
-			cleanup()
-		}
-	}()
+// Start a ticker to do cleanup (of games and of the matchmaking queues) every configured cleanup period.
+// Returns a function that stops it.
+func startCleanupTicker() func() {
+	return clock.Every(config.CleanupPeriod, func() {
+		registry.cleanup()
+		matchmaker.expire()
+	})
 }
@@ -0,0 +1,143 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Server settings that operators may tune per deployment.  Each setting is read from an environment
+// variable and may be overridden by a command line flag of the same meaning:
+//
+//	PORT                     -port              port to listen on (default 80)
+//	CLEANUP_PERIOD           -cleanup-period    how often idle players and games are cleaned up (default 15s)
+//	PLAYER_TIMEOUT           -player-timeout    how long a player may be unresponsive (default 90s)
+//	GAME_FORMATION_TIMEOUT   -formation-timeout how long a game may wait for its players (default 5m)
+//	PONG_WAIT                -pong-wait         how long to wait for a pong from a client (default 30s)
+//	PING_PERIOD              -ping-period       how often to ping clients (default 27s)
+//	SHUTDOWN_TIMEOUT         -shutdown-timeout  how long shutdown waits for clients to disconnect (default 10s)
+//	RECONNECT_GRACE          -reconnect-grace   how long a disconnected player may take to reconnect (default 0s)
+//
+// Durations use Go syntax (e.g. "90s", "5m").
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The tunable server settings
+type Config struct {
+	Port                 string
+	CleanupPeriod        time.Duration
+	PlayerTimeout        time.Duration
+	GameFormationTimeout time.Duration
+	PongWait             time.Duration
+	PingPeriod           time.Duration
+	ShutdownTimeout      time.Duration
+	ReconnectGrace       time.Duration
+}
+
+// The settings in effect.  Replaced by main with the result of loadConfig.
+var config = defaultConfig()
+
+// The settings used when nothing is specified
+func defaultConfig() *Config {
+	return &Config{
+		Port:                 defaultPort,
+		CleanupPeriod:        defaultCleanupPeriod,
+		PlayerTimeout:        defaultPlayerTimeout,
+		GameFormationTimeout: defaultGameFormationTimeout,
+		PongWait:             defaultPongWait,
+		PingPeriod:           defaultPingPeriod,
+		ShutdownTimeout:      defaultShutdownTimeout,
+		ReconnectGrace:       defaultReconnectGrace,
+	}
+}
+
+// Read the settings from the environment and then from the command line arguments
+func loadConfig(args []string) (*Config, error) {
+	config := defaultConfig()
+	config.Port = getenvDefault("PORT", config.Port)
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"CLEANUP_PERIOD", &config.CleanupPeriod},
+		{"PLAYER_TIMEOUT", &config.PlayerTimeout},
+		{"GAME_FORMATION_TIMEOUT", &config.GameFormationTimeout},
+		{"PONG_WAIT", &config.PongWait},
+		{"PING_PERIOD", &config.PingPeriod},
+		{"SHUTDOWN_TIMEOUT", &config.ShutdownTimeout},
+		{"RECONNECT_GRACE", &config.ReconnectGrace},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", setting.name, err)
+			}
+			*setting.value = duration
+		}
+	}
+	flags := flag.NewFlagSet("unigame-server", flag.ContinueOnError)
+	flags.StringVar(&config.Port, "port", config.Port, "port to listen on")
+	flags.DurationVar(&config.CleanupPeriod, "cleanup-period", config.CleanupPeriod,
+		"how often idle players and games are cleaned up")
+	flags.DurationVar(&config.PlayerTimeout, "player-timeout", config.PlayerTimeout,
+		"how long a player may be unresponsive before it is removed")
+	flags.DurationVar(&config.GameFormationTimeout, "formation-timeout", config.GameFormationTimeout,
+		"how long a game may wait for all its players")
+	flags.DurationVar(&config.PongWait, "pong-wait", config.PongWait, "how long to wait for a pong from a client")
+	flags.DurationVar(&config.PingPeriod, "ping-period", config.PingPeriod, "how often to ping clients")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout,
+		"how long shutdown waits for clients to disconnect")
+	flags.DurationVar(&config.ReconnectGrace, "reconnect-grace", config.ReconnectGrace,
+		"how long a disconnected player may take to reconnect before it is reported lost (0 for no grace)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Check that the settings are consistent
+func (c *Config) validate() error {
+	if c.CleanupPeriod <= 0 || c.PongWait <= 0 || c.PingPeriod <= 0 {
+		return errors.New("the cleanup period, pong wait and ping period must be positive")
+	}
+	if c.PingPeriod >= c.PongWait {
+		return errors.New("the ping period must be less than the pong wait")
+	}
+	if c.PlayerTimeout < c.CleanupPeriod || c.GameFormationTimeout < c.CleanupPeriod {
+		return errors.New("the player and game formation timeouts must be at least the cleanup period")
+	}
+	if c.ReconnectGrace < 0 || c.ReconnectGrace > c.PlayerTimeout {
+		return errors.New("the reconnect grace must not be negative or longer than the player timeout")
+	}
+	return nil
+}
+
+// The number of times cleanup may find a player unresponsive before removing it
+func (c *Config) playerIdleLimit() int {
+	return int(c.PlayerTimeout / c.CleanupPeriod)
+}
+
+// The number of times cleanup may find a game incomplete before deleting it
+func (c *Config) gameFormationIdleLimit() int {
+	return int(c.GameFormationTimeout / c.CleanupPeriod)
+}
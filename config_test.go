@@ -0,0 +1,83 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("PORT", "8080")
+	t.Setenv("GAME_FORMATION_TIMEOUT", "10m")
+	t.Setenv("PLAYER_TIMEOUT", "1m")
+	t.Setenv("RECONNECT_GRACE", "45s")
+	loaded, err := loadConfig([]string{"-player-timeout", "2m", "-cleanup-period", "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultConfig()
+	expected.Port = "8080"
+	expected.GameFormationTimeout = 10 * time.Minute
+	expected.PlayerTimeout = 2 * time.Minute
+	expected.CleanupPeriod = 30 * time.Second
+	expected.ReconnectGrace = 45 * time.Second
+	if *loaded != *expected {
+		t.Fatalf("expected %+v, got %+v", expected, loaded)
+	}
+	if loaded.playerIdleLimit() != 4 || loaded.gameFormationIdleLimit() != 20 {
+		t.Fatalf("unexpected idle limits %d and %d", loaded.playerIdleLimit(), loaded.gameFormationIdleLimit())
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"-ping-period", "30s", "-pong-wait", "30s"},
+		{"-cleanup-period", "0s"},
+		{"-formation-timeout", "10s"},
+		{"-player-timeout", "soon"},
+		{"-reconnect-grace", "-1s"},
+		{"-reconnect-grace", "2m"},
+	} {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	t.Setenv("PONG_WAIT", "soon")
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("expected an error for an invalid environment variable")
+	}
+}
+
+func TestConfiguredFormationTimeout(t *testing.T) {
+	saved := *config
+	t.Cleanup(func() { *config = saved })
+	config.GameFormationTimeout = 30 * time.Second
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	advance(30 * time.Second)
+	if registry.lookup(testGame) == nil {
+		t.Fatal("game deleted before its formation timeout")
+	}
+	advance(config.CleanupPeriod)
+	if registry.lookup(testGame) != nil {
+		t.Fatal("incomplete game not deleted after the configured formation timeout")
+	}
+	a.expectClosed()
+}
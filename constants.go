@@ -17,6 +17,8 @@
 
 package main
 
+import "time"
+
 // Constants used in the backend
 
 const (
@@ -30,19 +32,92 @@ const (
 	pathReset     = "/reset"
 	pathDump      = "/dump"
 	pathWebsocket = "/websocket"
+	pathMatchmake = "/matchmake"
+	pathMetrics   = "/metrics"
+
+	// URL paths of the lobby functions
+	pathCreateGame = "/createGame"
+	pathOpenGames  = "/openGames"
 
-	// Period at which the cleanup function is called, in seconds
-	cleanupPeriod = 15
+	// URL paths of the admin functions on individual games
+	pathListGames     = "/admin/listGames"
+	pathGetGame       = "/admin/getGame"
+	pathDeleteGame    = "/admin/deleteGame"
+	pathKickPlayer    = "/admin/kickPlayer"
+	pathSetNumPlayers = "/admin/setNumPlayers"
 
 	// Default port to listen on if a port is not specified via the environment
 	defaultPort = "80"
 
-	// Timeouts for idle players and for game formation, as multiples of the cleanup period.
-	playerTimeout        = 90 / cleanupPeriod
-	gameFormationTimeout = 300 / cleanupPeriod
+	// Defaults for the timing settings in Config
+	defaultCleanupPeriod        = 15 * time.Second
+	defaultPlayerTimeout        = 90 * time.Second
+	defaultGameFormationTimeout = 300 * time.Second
+	defaultPongWait             = 30 * time.Second
+	defaultPingPeriod           = (defaultPongWait * 9) / 10
+	defaultShutdownTimeout      = 10 * time.Second
+	defaultReconnectGrace       = 0
+
+	// The body of the server-going-away message and the reason in the accompanying close frame
+	goingAwayReason = "server shutting down"
+
+	// Number of recent chat messages retained by each game for replay to (re)joining players
+	chatReplayCount = 20
+
+	// Number of recent messages retained by each game for resending to players resuming a session
+	resumeHistorySize = 256
+
+	// How long a resume token remains valid after it is issued
+	resumeTokenLifetime = 24 * time.Hour
+
+	// Error codes returned (under the key "code") when a websocket cannot be opened
+	errCodePlayerTaken        = "player-taken"         // the player order number belongs to a different user
+	errCodeNoSuchGame         = "no-such-game"         // a spectator asked to watch a game that does not exist
+	errCodeWrongSecret        = "wrong-secret"         // the game secret was wrong or missing
+	errCodeInvalidOrder       = "invalid-order"        // the order number is 0 or above the number of players
+	errCodeNumPlayersMismatch = "num-players-mismatch" // NumPlayers conflicts with the game's number of players
+	errCodeInvalidNumPlayers  = "invalid-num-players"  // NumPlayers is above maxNumPlayers
+	errCodeGameFull           = "game-full"            // the game already has all its players
+	errCodeTooManyAttempts    = "too-many-attempts"    // too many wrong secrets for the game; try again later
+	errCodeInvalidResumeToken = "invalid-resume-token" // the resume token is malformed, forged or another user's
+	errCodeNoSuchPlayer       = "no-such-player"       // the player of a resume token is no longer in the game
+
+	// Error code returned by the lobby when a user already has too many reserved games that nobody has joined
+	errCodeTooManyReservations = "too-many-reservations"
+
+	// Largest number of players a game may have
+	maxNumPlayers = 32
+
+	// Number of wrong secrets a user may present for a game within the failure window
+	maxSecretFailures   = 5
+	secretFailureWindow = time.Minute
+
+	// Join codes generated by the lobby: their length and the characters used (omitting look-alikes
+	// such as 0 and O, 1 and I)
+	joinCodeLen      = 6
+	joinCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+	// Number of reserved games, not yet joined by anyone, that one user may have at a time
+	maxReservationsPerUser = 5
+
+	// Maximum lengths of a spectator name and of the player name given for matchmaking
+	maxSpectatorNameLen = 64
+	maxPlayerNameLen    = 64
 
 	// Query value keys used for websocket creation
-	playerKey     = "Player"
-	gameTokenKey  = "GameToken"
-	numPlayersKey = "NumPlayers"
+	playerKey       = "Player"
+	gameTokenKey    = "GameToken"
+	numPlayersKey   = "NumPlayers"
+	enforceTurnsKey = "EnforceTurns"
+	secretKey       = "Secret"
+	publicKey       = "Public"
+	resumeTokenKey  = "ResumeToken"
+
+	// Query value keys used for matchmaking websocket creation (plus numPlayersKey)
+	appIdKey      = "AppId"
+	playerNameKey = "PlayerName"
+
+	// Query value keys used for spectator websocket creation
+	spectatorKey     = "Spectator"
+	spectatorChatKey = "Chat"
 )
@@ -6,11 +6,11 @@ require (
 	github.com/auth0/go-jwt-middleware/v2 v2.2.0
 	github.com/gorilla/websocket v1.5.1
 	golang.org/x/exp v0.0.0-20230202163644-54bba9f4231b
+	gopkg.in/go-jose/go-jose.v2 v2.6.1
 )
 
 require (
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
-	gopkg.in/go-jose/go-jose.v2 v2.6.1 // indirect
 )
@@ -0,0 +1,509 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Test harness: an in-process server running the real handler tree with HS256 token validation, and
+// a websocket client that joins games and checks the messages it receives.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Token validation settings used by all tests
+var testAuthConfig = &AuthConfig{
+	Mode:     authModeHS256,
+	Issuer:   defaultLocalIssuerAndAudience,
+	Audience: defaultLocalIssuerAndAudience,
+	Secret:   "test-secret",
+}
+
+// How long a client waits for an expected message
+const expectTimeout = 2 * time.Second
+
+// How long a client waits to be sure no message is coming
+const quietTimeout = 100 * time.Millisecond
+
+func TestMain(m *testing.M) {
+	if os.Getenv("TEST_LOG") == "" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	if err := setupTokenValidation(testAuthConfig); err != nil {
+		panic(err)
+	}
+	clock = testClock
+	os.Exit(m.Run())
+}
+
+// A Clock whose time only moves when told to.  Periodic callbacks run synchronously in Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	period  time.Duration
+	next    time.Time
+	f       func()
+	stopped bool
+}
+
+// The clock used by all tests
+var testClock = &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Every(period time.Duration, f func()) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &fakeTicker{period: period, next: c.now.Add(period), f: f}
+	c.tickers = append(c.tickers, ticker)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		ticker.stopped = true
+	}
+}
+
+// Move time forward, running each periodic callback as many times as it falls due, in time order
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var due *fakeTicker
+		for _, ticker := range c.tickers {
+			if !ticker.stopped && !ticker.next.After(end) && (due == nil || ticker.next.Before(due.next)) {
+				due = ticker
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.period)
+		c.mu.Unlock()
+		due.f()
+	}
+}
+
+// Give disconnected players a reconnect grace period (see reconnect.go) for the rest of a test.  The server
+// reads the grace under the registry lock, so it is changed under that lock too: clients of an earlier test
+// may still be disconnecting.
+func setReconnectGrace(t *testing.T, grace time.Duration) {
+	set := func(grace time.Duration) {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		config.ReconnectGrace = grace
+	}
+	saved := config.ReconnectGrace
+	t.Cleanup(func() { set(saved) })
+	set(grace)
+}
+
+// An in-process server with its cleanup ticker driven by the test clock.  All games and matchmaking
+// queues are deleted when the test ends.
+type testServer struct {
+	*httptest.Server
+	t *testing.T
+}
+
+func newTestServer(t *testing.T) *testServer {
+	server := httptest.NewServer(newHandler())
+	stopCleanup := startCleanupTicker()
+	t.Cleanup(func() {
+		stopCleanup()
+		matchmaker.shutdown()
+		registry.reset()
+		server.Close()
+	})
+	return &testServer{server, t}
+}
+
+// Mint a token for a subject with the given permissions
+func (s *testServer) token(subject string, permissions ...string) string {
+	token, err := mintToken(testAuthConfig, subject, permissions, time.Hour)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+// POST a JSON body to a path with the given token, returning the status and decoded response
+func (s *testServer) post(path string, token string, body interface{}) (int, map[string]interface{}) {
+	var decoded map[string]interface{}
+	status := s.postDecode(path, token, body, &decoded)
+	return status, decoded
+}
+
+// POST a JSON body to a path with the given token, decoding the response into result.  Returns the status.
+func (s *testServer) postDecode(path string, token string, body interface{}, result interface{}) int {
+	encoded, _ := json.Marshal(body)
+	request, _ := http.NewRequest(http.MethodPost, s.URL+path, bytes.NewReader(encoded))
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	json.Unmarshal(data, result)
+	return response.StatusCode
+}
+
+// Scrape the metrics endpoint, returning the value of each series (name and labels) it lists
+func (s *testServer) metrics() map[string]int64 {
+	response, err := http.Get(s.URL + pathMetrics)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	series := map[string]int64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndex(line, " ")
+		value, err := strconv.ParseInt(line[separator+1:], 10, 64)
+		if err != nil {
+			s.t.Fatalf("malformed metrics line %q", line)
+		}
+		series[line[:separator]] = value
+	}
+	return series
+}
+
+// A websocket client of the test server
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	protocol int
+	leader   bool // Whether leader announcements are received rather than skipped
+	// The last resume token received.  Resume tokens are recorded here rather than returned as messages.
+	resumeToken string
+}
+
+// A message as received by a test client
+type received struct {
+	msgType byte
+	body    string
+	env     envelope // Only for protocol v2
+}
+
+// Options for joining a game
+type joinOptions struct {
+	protocol int        // protocolV1 (default) or protocolV2
+	query    url.Values // Additional query values
+	leader   bool       // Receive leader announcements, which are otherwise skipped
+}
+
+// Join a game as a player, failing the test if the websocket cannot be opened
+func (s *testServer) join(subject string, gameToken string, player string, numPlayers string,
+	options ...joinOptions) *testClient {
+	client, response, err := s.tryJoin(subject, gameToken, player, numPlayers, options...)
+	if err != nil {
+		status := 0
+		if response != nil {
+			status = response.StatusCode
+		}
+		s.t.Fatalf("could not join %s as %s: %v (status %d)", gameToken, player, err, status)
+	}
+	return client
+}
+
+// Try to join a game as a player, returning the handshake response and error on failure
+func (s *testServer) tryJoin(subject string, gameToken string, player string, numPlayers string,
+	options ...joinOptions) (*testClient, *http.Response, error) {
+	query := url.Values{}
+	var option joinOptions
+	if len(options) > 0 {
+		option = options[0]
+		for key, values := range option.query {
+			query[key] = values
+		}
+	}
+	if player != "" {
+		query.Set(playerKey, player)
+	}
+	if gameToken != "" {
+		query.Set(gameTokenKey, gameToken)
+	}
+	if numPlayers != "" {
+		query.Set(numPlayersKey, numPlayers)
+	}
+	client, response, err := s.dial(subject, pathWebsocket, query, option.protocol)
+	if client != nil {
+		client.leader = option.leader
+	}
+	return client, response, err
+}
+
+// Resume a session with a resume token, returning the handshake response and error on failure
+func (s *testServer) tryResume(subject string, resumeToken string, options ...joinOptions) (*testClient,
+	*http.Response, error) {
+	var option joinOptions
+	if len(options) > 0 {
+		option = options[0]
+	}
+	client, response, err := s.dial(subject, pathWebsocket, url.Values{resumeTokenKey: {resumeToken}},
+		option.protocol)
+	if client != nil {
+		client.leader = option.leader
+	}
+	return client, response, err
+}
+
+// Watch a game as a spectator, failing the test if the websocket cannot be opened
+func (s *testServer) spectate(subject string, gameToken string, name string, options ...joinOptions) *testClient {
+	query := url.Values{gameTokenKey: {gameToken}, spectatorKey: {name}}
+	var option joinOptions
+	if len(options) > 0 {
+		option = options[0]
+		for key, values := range option.query {
+			query[key] = values
+		}
+	}
+	client, response, err := s.dial(subject, pathWebsocket, query, option.protocol)
+	if err != nil {
+		s.t.Fatalf("could not watch %s as %s: %v (response %v)", gameToken, name, err, response)
+	}
+	client.leader = option.leader
+	return client
+}
+
+// Fail unless a websocket handshake was rejected with the given status and error code
+func expectRejected(t *testing.T, response *http.Response, err error, status int, code string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected status %d but the websocket was opened", status)
+	}
+	if response == nil || response.StatusCode != status {
+		t.Fatalf("expected status %d, got %v", status, response)
+	}
+	var decoded map[string]string
+	data, _ := io.ReadAll(response.Body)
+	json.Unmarshal(data, &decoded)
+	if decoded["code"] != code {
+		t.Fatalf("expected error code %q, got %s", code, data)
+	}
+}
+
+// Open a websocket on the given path
+func (s *testServer) dial(subject string, path string, query url.Values, protocol int) (*testClient,
+	*http.Response, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: expectTimeout}
+	if protocol == protocolV2 {
+		dialer.Subprotocols = []string{subprotocolV2}
+	} else {
+		protocol = protocolV1
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+s.token(subject))
+	target := "ws" + strings.TrimPrefix(s.URL, "http") + path + "?" + query.Encode()
+	conn, response, err := dialer.Dial(target, header)
+	if err != nil {
+		return nil, response, err
+	}
+	client := &testClient{t: s.t, conn: conn, protocol: protocol}
+	s.t.Cleanup(func() { conn.Close() })
+	return client, response, nil
+}
+
+// Queue for matchmaking, failing the test if the websocket cannot be opened
+func (s *testServer) matchmake(subject string, appId string, numPlayers string, name string) *testClient {
+	query := url.Values{appIdKey: {appId}, numPlayersKey: {numPlayers}, playerNameKey: {name}}
+	client, response, err := s.dial(subject, pathMatchmake, query, protocolV1)
+	if err != nil {
+		s.t.Fatalf("could not queue for matchmaking: %v (response %v)", err, response)
+	}
+	return client
+}
+
+// Send a message
+func (c *testClient) send(msgType byte, body string) {
+	c.t.Helper()
+	var data []byte
+	if c.protocol == protocolV2 {
+		data, _ = json.Marshal(envelope{Version: protocolV2, Type: string(msgType), Body: []byte(body)})
+	} else {
+		data = append([]byte{msgType}, body...)
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Send a protocol v2 envelope
+func (c *testClient) sendEnvelope(env envelope) {
+	c.t.Helper()
+	env.Version = protocolV2
+	data, _ := json.Marshal(env)
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Read the next message, waiting at most the given time.  Leader announcements are skipped unless the
+// client asked for them, and resume tokens are recorded and skipped.
+func (c *testClient) read(timeout time.Duration) (*received, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		var msg *received
+		if c.protocol == protocolV2 {
+			var env envelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				return nil, err
+			}
+			msg = &received{msgType: env.Type[0], body: string(env.Body), env: env}
+		} else {
+			msg = &received{msgType: data[0], body: string(data[1:])}
+		}
+		switch {
+		case msg.msgType == resumeTokenType:
+			c.resumeToken = msg.body
+		case msg.msgType != leaderType || c.leader:
+			return msg, nil
+		}
+	}
+}
+
+// Read the next message as JSON into result, failing if there is none
+func (c *testClient) readJSON(result interface{}) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(expectTimeout))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("expected a JSON message but got error %v", err)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		c.t.Fatalf("could not decode %s: %v", data, err)
+	}
+}
+
+// Read the next message, failing unless it has the expected type.  Returns the message.
+func (c *testClient) expectMessage(msgType byte) *received {
+	c.t.Helper()
+	msg, err := c.read(expectTimeout)
+	if err != nil {
+		c.t.Fatalf("expected message of type %c but got error %v", msgType, err)
+	}
+	if msg.msgType != msgType {
+		c.t.Fatalf("expected message of type %c but got %c%s", msgType, msg.msgType, msg.body)
+	}
+	return msg
+}
+
+// Read the next message, failing unless it has the expected type and body
+func (c *testClient) expect(msgType byte, body string) {
+	c.t.Helper()
+	if msg := c.expectMessage(msgType); msg.body != body {
+		c.t.Fatalf("expected %c%s but got %c%s", msgType, body, msg.msgType, msg.body)
+	}
+}
+
+// Fail if a message arrives within a short time
+func (c *testClient) expectNothing() {
+	c.t.Helper()
+	if msg, err := c.read(quietTimeout); err == nil {
+		c.t.Fatalf("expected no message but got %c%s", msg.msgType, msg.body)
+	}
+}
+
+// Fail unless the server closes the connection
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	for {
+		msg, err := c.read(expectTimeout)
+		if err == nil {
+			continue // Skip messages sent before the close
+		}
+		if _, ok := err.(*websocket.CloseError); ok || !strings.Contains(err.Error(), "timeout") {
+			return
+		}
+		c.t.Fatalf("expected connection to close but it is still open (last message %v)", msg)
+	}
+}
+
+// Fail unless the server closes the connection with the given close code
+func (c *testClient) expectCloseCode(code int) {
+	c.t.Helper()
+	msg, err := c.read(expectTimeout)
+	if err == nil {
+		c.t.Fatalf("expected close %d but got %c%s", code, msg.msgType, msg.body)
+	}
+	if !websocket.IsCloseError(err, code) {
+		c.t.Fatalf("expected close %d but got %v", code, err)
+	}
+}
+
+// Close the connection abruptly
+func (c *testClient) close() {
+	c.conn.Close()
+}
+
+// Advance the test clock, running cleanup once for each cleanup period that passes
+func advance(d time.Duration) {
+	testClock.Advance(d)
+}
+
+// Wait until a condition holds, failing the test if it does not within the expect timeout
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(expectTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Wait until the number of goroutines is at most n
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	eventually(t, "goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= n
+	})
+}
@@ -0,0 +1,1325 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// End-to-end tests using the in-process server and websocket client of the test harness.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Player tokens used in the tests (base64 player name plus order number)
+const (
+	alice = "YWxpY2U=:1"
+	bob   = "Ym9i:2"
+	carol = "Y2Fyb2w=:3"
+)
+
+const testGame = "tests_somegame"
+
+func TestGameFormation(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expect(playerListType, "2 "+alice)
+	b := server.join("bob", testGame, bob, "")
+	a.expect(playerListType, "2 "+alice+" "+bob)
+	b.expect(playerListType, "2 "+alice+" "+bob)
+}
+
+func TestChatAndGameStateRelay(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+
+	a.send(chatType, " hello\nthere ")
+	a.expect(chatType, "hello there")
+	b.expect(chatType, "hello there")
+
+	b.send(gameStateType, "{\"board\":1}")
+	a.expect(gameStateType, "{\"board\":1}")
+	b.expect(gameStateType, "{\"board\":1}")
+}
+
+func TestLostPlayer(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.close()
+	a.expect(lostPlayerType, bob)
+}
+
+func TestReconnectionReplaysState(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	a.send(gameStateType, "state1")
+	a.send(chatType, "hi")
+	a.send(gameStateType, "state2")
+	b.expect(gameStateType, "state1")
+	b.expect(chatType, "hi")
+	b.expect(gameStateType, "state2")
+	b.close()
+	a.expect(gameStateType, "state1")
+	a.expect(chatType, "hi")
+	a.expect(gameStateType, "state2")
+	a.expect(lostPlayerType, bob)
+
+	// Reconnecting gets the latest game state and the recent chat, then the player list
+	b = server.join("bob", testGame, bob, "")
+	b.expect(gameStateType, "state2")
+	b.expect(chatType, "hi")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	a.expect(playerListType, "2 "+alice+" "+bob)
+}
+
+func TestReconnectionWithinGrace(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.expect(startedType, "")
+	a.send(gameStateType, "state1")
+	a.send(chatType, "hi")
+	b.expect(gameStateType, "state1")
+	b.expect(chatType, "hi")
+	b.close()
+	a.expect(gameStateType, "state1")
+	a.expect(chatType, "hi")
+	a.expect(disconnectedType, bob)
+	advance(config.ReconnectGrace - config.CleanupPeriod)
+	eventually(t, "bob to stay disconnected before the grace expires", func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return registry.games[testGame].Players[2].State == playerDisconnected
+	})
+
+	// Reconnecting within the grace period gets the latest game state, the recent chat and the start, then
+	// the player list.  Everyone is told of the reconnection but the player list is not resent.
+	b = server.join("bob", testGame, bob, "", v2)
+	b.expect(gameStateType, "state1")
+	b.expect(chatType, "hi")
+	b.expect(startedType, "")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	b.expect(reconnectedType, bob)
+	a.expect(reconnectedType, bob)
+	a.expectNothing()
+}
+
+func TestReconnectionAfterGrace(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.close()
+	a.expect(disconnectedType, bob)
+	advance(config.ReconnectGrace + config.CleanupPeriod)
+	a.expect(lostPlayerType, bob)
+	eventually(t, "bob to be lost", func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return registry.games[testGame].Players[2].State == playerLost
+	})
+
+	// A lost player that returns before it is removed rejoins as usual
+	b = server.join("bob", testGame, bob, "", v2)
+	b.expect(startedType, "")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	a.expect(playerListType, "2 "+alice+" "+bob)
+}
+
+func TestNoReconnectionGrace(t *testing.T) {
+	setReconnectGrace(t, 0)
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.close()
+	a.expect(lostPlayerType, bob)
+}
+
+func TestV1ClientsNotSentNewMessageTypes(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{leader: true})
+	a.expect(playerListType, "2 "+alice)
+	b := server.join("bob", testGame, bob, "", joinOptions{protocol: protocolV2})
+	a.expect(playerListType, "2 "+alice+" "+bob)
+	b.expectMessage(playerListType)
+	b.expect(startedType, "")
+	// A v1 client sees neither the start, the leader, the disconnection nor a resume token; only the
+	// loss once the grace period has expired
+	b.close()
+	eventually(t, "bob to be disconnected", func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return registry.games[testGame].Players[2].State == playerDisconnected
+	})
+	advance(config.ReconnectGrace + config.CleanupPeriod)
+	a.expect(lostPlayerType, bob)
+	if a.resumeToken != "" {
+		t.Fatal("v1 client sent a resume token")
+	}
+	a.expectNothing()
+}
+
+func TestDisconnectedPlayerRemoved(t *testing.T) {
+	setReconnectGrace(t, config.PlayerTimeout)
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	a.expect(startedType, "")
+	// Bob stops responding, then disconnects, and is removed for being idle before his grace expires,
+	// which also makes him lost
+	player := registry.lookup(testGame).Players[1]
+	keepActive := func(d time.Duration) {
+		for elapsed := time.Duration(0); elapsed < d; elapsed += config.CleanupPeriod {
+			registry.markActive(player)
+			advance(config.CleanupPeriod)
+		}
+	}
+	keepActive(config.PlayerTimeout / 2)
+	b.close()
+	a.expect(disconnectedType, bob)
+	keepActive(config.PlayerTimeout / 2)
+	if registry.lookup(testGame).Players[2] == nil {
+		t.Fatal("idle player removed early")
+	}
+	keepActive(config.CleanupPeriod)
+	a.expect(lostPlayerType, bob)
+	a.expectNothing()
+	if registry.lookup(testGame).Players[2] != nil {
+		t.Fatal("idle player not removed")
+	}
+}
+
+func TestReconnectionReplacesOldClient(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	a2 := server.join("alice", testGame, alice, "2")
+	a2.expect(playerListType, "2 "+alice)
+	a.expectClosed()
+}
+
+func TestPlayerBoundToSubject(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	_, response, err := server.tryJoin("mallory", testGame, alice, "2")
+	if err == nil {
+		t.Fatal("a different user was able to connect as an existing player")
+	}
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %v", http.StatusForbidden, response)
+	}
+	a.expectNothing()
+}
+
+func TestInvalidJoinRequests(t *testing.T) {
+	server := newTestServer(t)
+	for _, test := range []struct{ gameToken, player, numPlayers string }{
+		{"", alice, "2"},
+		{"short", alice, "2"},
+		{testGame, "", "2"},
+		{testGame, "no-order", "2"},
+		{testGame, alice, "two"},
+	} {
+		_, response, err := server.tryJoin("alice", test.gameToken, test.player, test.numPlayers)
+		if err == nil || response.StatusCode != http.StatusBadRequest {
+			t.Errorf("join %v: expected status %d, got %v", test, http.StatusBadRequest, response)
+		}
+	}
+}
+
+func TestInvalidTokenRejected(t *testing.T) {
+	server := newTestServer(t)
+	status, _ := server.post(pathListGames, "not-a-token", map[string]string{})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestFormationTimeout(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	// Keep the player responsive, as its pongs would, so only the formation timeout applies
+	player := registry.lookup(testGame).Players[1]
+	for elapsed := time.Duration(0); elapsed < config.GameFormationTimeout; elapsed += config.CleanupPeriod {
+		registry.markActive(player)
+		advance(config.CleanupPeriod)
+	}
+	if registry.lookup(testGame) == nil {
+		t.Fatal("game deleted before its formation timeout")
+	}
+	advance(config.CleanupPeriod)
+	if registry.lookup(testGame) != nil {
+		t.Fatal("incomplete game not deleted after its formation timeout")
+	}
+	a.expectClosed()
+}
+
+func TestIdlePlayerTimeout(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	// No pongs are exchanged within the test, so both players go idle
+	advance(config.PlayerTimeout)
+	if registry.lookup(testGame) == nil {
+		t.Fatal("players removed before their timeout")
+	}
+	advance(config.CleanupPeriod)
+	if registry.lookup(testGame) != nil {
+		t.Fatal("game without players not deleted")
+	}
+	a.expectClosed()
+	b.expectClosed()
+}
+
+func TestMetrics(t *testing.T) {
+	server := newTestServer(t)
+	const (
+		games     = "unigame_active_games"
+		clients   = "unigame_connected_clients"
+		relayed   = `unigame_messages_relayed_total{type="G"}`
+		idle      = `unigame_cleanup_deletions_total{reason="idle_player"}`
+		emptyGame = `unigame_cleanup_deletions_total{reason="empty_game"}`
+		jwt       = "unigame_jwt_validation_failures_total"
+		overflows = "unigame_send_buffer_overflows_total"
+	)
+	before := server.metrics()
+	changed := func(series string, by int64) bool {
+		return server.metrics()[series]-before[series] == by
+	}
+
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	eventually(t, "both clients to be counted", func() bool { return changed(clients, 2) })
+	if !changed(games, 1) {
+		t.Fatalf("%s not incremented by the join", games)
+	}
+
+	a.send(gameStateType, "state1")
+	b.expect(gameStateType, "state1")
+	if !changed(relayed, 1) {
+		t.Fatalf("%s not incremented by the relay", relayed)
+	}
+
+	// A client that never reads is dropped once its send buffer is full.  The replayed game state fills it.
+	registry.lookup(testGame).Hub.registerClient(&Client{send: make(chan *Message, 1)})
+	a.send(gameStateType, "state2")
+	b.expect(gameStateType, "state2")
+	eventually(t, "the overflow to be counted", func() bool { return changed(overflows, 1) })
+
+	server.post(pathListGames, "not-a-token", map[string]string{})
+	if !changed(jwt, 1) {
+		t.Fatalf("%s not incremented by an invalid token", jwt)
+	}
+
+	// Both players go idle, so cleanup deletes them and then their game
+	advance(config.PlayerTimeout + config.CleanupPeriod)
+	a.expectClosed()
+	b.expectClosed()
+	if !changed(idle, 2) || !changed(emptyGame, 1) || !changed(games, 0) {
+		t.Fatalf("cleanup deletions not counted: %v", server.metrics())
+	}
+	eventually(t, "both clients to be uncounted", func() bool { return changed(clients, 0) })
+}
+
+func TestTargetedMessages(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "3")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	c := server.join("carol", testGame, carol, "", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	c.expectMessage(playerListType)
+	c.expect(startedType, "")
+
+	a.send(targetedType, "3,4\nyour cards")
+	a.expect(errorType, "unknown recipients: 4")
+	msg := c.expectMessage(targetedType)
+	if msg.body != "your cards" || msg.env.Sender != alice {
+		t.Fatalf("unexpected targeted message %+v", msg)
+	}
+	c.sendEnvelope(envelope{Type: string(targetedType), To: []uint32{2}, Body: []byte("psst")})
+	b.expect(targetedType, carol+"\npsst")
+	a.expectNothing()
+}
+
+func TestTurnEnforcement(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{query: url.Values{enforceTurnsKey: {"true"}}})
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	b.expect(startedType, "")
+
+	b.send(gameStateType, "early")
+	b.expect(errorType, "It is not your turn")
+	a.send(gameStateType, "move1")
+	a.expect(gameStateType, "move1")
+	b.expect(gameStateType, "move1")
+	a.send(turnType, "")
+	a.expect(turnType, "2")
+	b.expect(turnType, "2")
+	a.send(gameStateType, "late")
+	a.expect(errorType, "It is not your turn")
+	b.sendEnvelope(envelope{Type: string(gameStateType), EndTurn: true, Body: []byte("move2")})
+	a.expect(gameStateType, "move2")
+	a.expect(turnType, "1")
+}
+
+func TestProtocolV2Envelope(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{protocol: protocolV2})
+	first := a.expectMessage(playerListType)
+	a.send(chatType, "hello")
+	second := a.expectMessage(chatType)
+	if second.env.Sender != alice || second.env.Seq <= first.env.Seq || second.env.Time == 0 {
+		t.Fatalf("envelope fields not set: %+v then %+v", first.env, second.env)
+	}
+}
+
+func TestHubStopsWhenGameDeleted(t *testing.T) {
+	server := newTestServer(t)
+	base := runtime.NumGoroutine()
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	if !registry.endGame(testGame, phaseAbandoned) {
+		t.Fatal("game not found")
+	}
+	a.expectClosed()
+	a.close()
+	waitForGoroutines(t, base)
+}
+
+func TestAdminFunctions(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+
+	admin := server.token("admin", "admin:server")
+	if status, _ := server.post(pathListGames, server.token("alice"), map[string]string{}); status != http.StatusForbidden {
+		t.Fatalf("non-admin got status %d", status)
+	}
+	status, response := server.post(pathKickPlayer, admin, map[string]interface{}{"gameToken": testGame, "player": 2})
+	if status != http.StatusOK {
+		t.Fatalf("kick failed: %d %v", status, response)
+	}
+	b.expectClosed()
+	a.expect(lostPlayerType, bob)
+	a.expect(playerListType, "2 "+alice)
+
+	status, _ = server.post(pathSetNumPlayers, admin, map[string]interface{}{"gameToken": testGame, "numPlayers": 3})
+	if status != http.StatusOK {
+		t.Fatalf("setNumPlayers failed: %d", status)
+	}
+	a.expect(playerListType, "3 "+alice)
+
+	status, _ = server.post(pathDeleteGame, admin, map[string]interface{}{"gameToken": testGame})
+	if status != http.StatusOK {
+		t.Fatalf("delete failed: %d", status)
+	}
+	a.expectClosed()
+	status, _ = server.post(pathGetGame, admin, map[string]interface{}{"gameToken": testGame})
+	if status != http.StatusNotFound {
+		t.Fatalf("deleted game still found: %d", status)
+	}
+}
+
+func TestSetNumPlayersValidation(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "3")
+	a.expectMessage(playerListType)
+	c := server.join("carol", testGame, carol, "")
+	c.expectMessage(playerListType)
+	admin := server.token("admin", "admin:server")
+	for _, test := range []struct {
+		numPlayers int
+		status     int
+		code       string
+	}{
+		{1, http.StatusConflict, errCodeNumPlayersMismatch},
+		{2, http.StatusBadRequest, errCodeInvalidOrder},
+	} {
+		status, response := server.post(pathSetNumPlayers, admin,
+			map[string]interface{}{"gameToken": testGame, "numPlayers": test.numPlayers})
+		if status != test.status || response["code"] != test.code {
+			t.Errorf("numPlayers %d: expected %d %s, got %d %v", test.numPlayers, test.status, test.code, status,
+				response)
+		}
+	}
+	registry.mu.Lock()
+	numPlayers := registry.games[testGame].NumPlayers
+	registry.mu.Unlock()
+	if numPlayers != 3 {
+		t.Fatalf("rejected change applied: %d players", numPlayers)
+	}
+	status, _ := server.post(pathSetNumPlayers, admin, map[string]interface{}{"gameToken": testGame, "numPlayers": 4})
+	if status != http.StatusOK {
+		t.Fatalf("setNumPlayers failed: %d", status)
+	}
+}
+
+func TestKickDisconnectedPlayer(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	options := joinOptions{protocol: protocolV2, leader: true}
+	a := server.join("alice", testGame, alice, "3",
+		joinOptions{protocol: protocolV2, leader: true, query: url.Values{enforceTurnsKey: {"true"}}})
+	a.expect(playerListType, "3 "+alice)
+	a.expect(leaderType, "1")
+	b := server.join("bob", testGame, bob, "", options)
+	b.expect(leaderType, "1")
+	b.expect(playerListType, "3 "+alice+" "+bob)
+
+	// Alice, the leader and active player, is kicked while she may still reconnect
+	a.close()
+	b.expect(disconnectedType, alice)
+	admin := server.token("admin", "admin:server")
+	status, _ := server.post(pathKickPlayer, admin, map[string]interface{}{"gameToken": testGame, "player": 1})
+	if status != http.StatusOK {
+		t.Fatalf("kick failed: %d", status)
+	}
+	b.expect(lostPlayerType, alice)
+	b.expect(playerListType, "3 "+bob)
+	b.expect(leaderType, "2")
+	b.expect(turnType, "2")
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if game := registry.games[testGame]; game.Leader != 2 || game.ActivePlayer != 2 {
+		t.Fatalf("expected leader and active player 2, got %d and %d", game.Leader, game.ActivePlayer)
+	}
+}
+
+func TestConcurrentJoinsCleanupAndAdmin(t *testing.T) {
+	server := newTestServer(t)
+	admin := server.token("admin", "admin:server")
+	games := []string{"tests_race1", "tests_race2", "tests_race3"}
+	subjects := map[string]string{alice: "alice", bob: "bob", carol: "carol"}
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for _, gameToken := range games {
+			for player, subject := range subjects {
+				wg.Add(1)
+				go func(gameToken, player, subject string) {
+					defer wg.Done()
+					// Joins may be refused or cut short by the admin calls; only data races matter here
+					if client, _, err := server.tryJoin(subject, gameToken, player, "3"); err == nil {
+						client.close()
+					}
+				}(gameToken, player, subject)
+			}
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			advance(config.CleanupPeriod)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			for _, gameToken := range games {
+				body := map[string]interface{}{"gameToken": gameToken}
+				server.post(pathListGames, admin, map[string]string{})
+				server.post(pathGetGame, admin, body)
+				server.post(pathSetNumPlayers, admin, map[string]interface{}{"gameToken": gameToken, "numPlayers": 3})
+				server.post(pathKickPlayer, admin, map[string]interface{}{"gameToken": gameToken, "player": i%3 + 1})
+			}
+			server.post(pathDump, admin, map[string]string{})
+			if i == 5 {
+				server.post(pathDeleteGame, admin, map[string]interface{}{"gameToken": games[0]})
+				server.post(pathReset, admin, map[string]string{})
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Whatever survived is consistent
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for gameToken, game := range registry.games {
+		if len(game.Players) > 3 {
+			t.Errorf("%s has %d players", gameToken, len(game.Players))
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	server := newTestServer(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	base := runtime.NumGoroutine()
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	b.expect(startedType, "")
+
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
+	registry.shutdown(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("shutdown waited for its deadline although all clients disconnected")
+	}
+	a.expect(goingAwayType, goingAwayReason)
+	a.expectCloseCode(websocket.CloseGoingAway)
+	b.expect(goingAwayType, goingAwayReason)
+	b.expectCloseCode(websocket.CloseGoingAway)
+	if registry.count() != 0 {
+		t.Fatal("games remain after shutdown")
+	}
+	_, response, err := server.tryJoin("alice", testGame, alice, "2")
+	if err == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %v", http.StatusServiceUnavailable, response)
+	}
+	a.close()
+	b.close()
+	waitForGoroutines(t, base)
+}
+
+func TestSpectators(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	a.send(gameStateType, "state1")
+	a.expect(gameStateType, "state1")
+	a.send(chatType, "before")
+	a.expect(chatType, "before")
+
+	// A spectator gets the game state replayed, but not the chat, and is not a player
+	s := server.spectate("sam", testGame, "sam")
+	s.expect(gameStateType, "state1")
+	b := server.join("bob", testGame, bob, "")
+	a.expect(playerListType, "2 "+alice+" "+bob)
+	b.expectMessage(gameStateType)
+	b.expectMessage(chatType)
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	s.expect(playerListType, "2 "+alice+" "+bob)
+
+	a.send(chatType, "hello")
+	a.send(targetedType, "2\nsecret")
+	a.send(gameStateType, "state2")
+	s.expect(gameStateType, "state2")
+
+	// Anything a spectator sends is rejected
+	s.send(gameStateType, "mine")
+	s.expect(errorType, "Spectators may not send this message")
+	s.send(chatType, "hi")
+	s.expect(errorType, "Spectators may not send this message")
+
+	b.close()
+	s.expect(lostPlayerType, bob)
+	s.close()
+	a.expect(chatType, "hello")
+	a.expect(gameStateType, "state2")
+	a.expect(lostPlayerType, bob)
+	a.expectNothing()
+}
+
+func TestSpectatorChat(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	a.send(chatType, "before")
+	a.expect(chatType, "before")
+	s := server.spectate("sam", testGame, "sam", joinOptions{protocol: protocolV2,
+		query: url.Values{spectatorChatKey: {"true"}}})
+	s.expect(chatType, "before")
+	s.send(chatType, "hi all")
+	msg := a.expectMessage(chatType)
+	if msg.body != "hi all" {
+		t.Fatalf("unexpected chat %q", msg.body)
+	}
+	if msg = s.expectMessage(chatType); msg.env.Sender != "sam" {
+		t.Fatalf("unexpected sender %q", msg.env.Sender)
+	}
+}
+
+func TestSpectatingMissingGame(t *testing.T) {
+	server := newTestServer(t)
+	_, response, err := server.dial("sam", pathWebsocket,
+		url.Values{gameTokenKey: {testGame}, spectatorKey: {"sam"}}, protocolV1)
+	if err == nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %v", http.StatusNotFound, response)
+	}
+	if registry.count() != 0 {
+		t.Fatal("a spectator created a game")
+	}
+}
+
+func TestJoinSecret(t *testing.T) {
+	server := newTestServer(t)
+	withSecret := func(secret string) joinOptions {
+		return joinOptions{query: url.Values{secretKey: {secret}}}
+	}
+	a := server.join("alice", testGame, alice, "3", withSecret("open sesame"))
+	a.expectMessage(playerListType)
+
+	_, response, err := server.tryJoin("bob", testGame, bob, "")
+	expectRejected(t, response, err, http.StatusForbidden, errCodeWrongSecret)
+	_, response, err = server.tryJoin("bob", testGame, bob, "", withSecret("open barley"))
+	expectRejected(t, response, err, http.StatusForbidden, errCodeWrongSecret)
+	_, response, err = server.dial("sam", pathWebsocket, url.Values{gameTokenKey: {testGame}, spectatorKey: {"sam"}},
+		protocolV1)
+	expectRejected(t, response, err, http.StatusForbidden, errCodeWrongSecret)
+
+	// Another user with the secret may join, and so may the creator when reconnecting
+	c := server.join("carol", testGame, carol, "", withSecret("open sesame"))
+	c.expectMessage(playerListType)
+	a.expectMessage(playerListType)
+	a = server.join("alice", testGame, alice, "", withSecret("open sesame"))
+	a.expectMessage(playerListType)
+
+	// Too many failures lock the user out for the failure window, even with the right secret
+	for i := 2; i < maxSecretFailures; i++ {
+		_, response, err = server.tryJoin("bob", testGame, bob, "", withSecret("guess"))
+		expectRejected(t, response, err, http.StatusForbidden, errCodeWrongSecret)
+	}
+	_, response, err = server.tryJoin("bob", testGame, bob, "", withSecret("open sesame"))
+	expectRejected(t, response, err, http.StatusTooManyRequests, errCodeTooManyAttempts)
+	testClock.Advance(secretFailureWindow)
+	b := server.join("bob", testGame, bob, "", withSecret("open sesame"))
+	b.expectMessage(playerListType)
+}
+
+func TestCreateGame(t *testing.T) {
+	server := newTestServer(t)
+	user := server.token("alice")
+	status, response := server.post(pathCreateGame, user, map[string]interface{}{"appId": "tests", "numPlayers": 2})
+	if status != http.StatusOK {
+		t.Fatalf("create failed: %d %v", status, response)
+	}
+	code, _ := response["code"].(string)
+	gameToken, _ := response["gameToken"].(string)
+	if len(code) != joinCodeLen || gameToken != "tests_"+code || !isValidGameToken(gameToken) {
+		t.Fatalf("unexpected response %v", response)
+	}
+
+	// The reserved game survives cleanup without players and has the declared number of players
+	advance(config.PlayerTimeout + config.CleanupPeriod)
+	if registry.lookup(gameToken) == nil {
+		t.Fatal("reserved game deleted for having no players")
+	}
+	a := server.join("alice", gameToken, alice, "")
+	a.expect(playerListType, "2 "+alice)
+	b := server.join("bob", gameToken, bob, "")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+
+	for _, body := range []map[string]interface{}{
+		{"numPlayers": 2},
+		{"appId": "Bad App", "numPlayers": 2},
+		{"appId": "tests"},
+		{"appId": "tests", "numPlayers": 0},
+		{"appId": "tests", "numPlayers": maxNumPlayers + 1},
+	} {
+		if status, _ := server.post(pathCreateGame, user, body); status != http.StatusBadRequest {
+			t.Errorf("%v: expected status %d, got %d", body, http.StatusBadRequest, status)
+		}
+	}
+}
+
+func TestReservationLimit(t *testing.T) {
+	server := newTestServer(t)
+	aliceToken, bobToken := server.token("alice"), server.token("bob")
+	body := map[string]interface{}{"appId": "tests", "numPlayers": 2}
+	var first string
+	for i := 0; i < maxReservationsPerUser; i++ {
+		status, response := server.post(pathCreateGame, aliceToken, body)
+		if status != http.StatusOK {
+			t.Fatalf("create %d failed: %d %v", i, status, response)
+		}
+		if i == 0 {
+			first, _ = response["gameToken"].(string)
+		}
+	}
+	status, response := server.post(pathCreateGame, aliceToken, body)
+	if status != http.StatusTooManyRequests || response["code"] != errCodeTooManyReservations {
+		t.Fatalf("expected %d %s, got %d %v", http.StatusTooManyRequests, errCodeTooManyReservations, status, response)
+	}
+	if status, _ := server.post(pathCreateGame, bobToken, body); status != http.StatusOK {
+		t.Fatalf("another user's reservation refused: %d", status)
+	}
+
+	// Once someone joins one of the games, it no longer counts against the limit
+	a := server.join("bob", first, alice, "")
+	a.expectMessage(playerListType)
+	if status, _ := server.post(pathCreateGame, aliceToken, body); status != http.StatusOK {
+		t.Fatalf("create after a reserved game was joined failed: %d", status)
+	}
+}
+
+func TestReservedGameFormationTimeout(t *testing.T) {
+	server := newTestServer(t)
+	_, response := server.post(pathCreateGame, server.token("alice"),
+		map[string]interface{}{"appId": "tests", "numPlayers": 2, "secret": "open sesame"})
+	gameToken, _ := response["gameToken"].(string)
+	_, httpResponse, err := server.tryJoin("alice", gameToken, alice, "")
+	expectRejected(t, httpResponse, err, http.StatusForbidden, errCodeWrongSecret)
+	advance(config.GameFormationTimeout)
+	if registry.lookup(gameToken) == nil {
+		t.Fatal("reserved game deleted before its formation timeout")
+	}
+	advance(config.CleanupPeriod)
+	if registry.lookup(gameToken) != nil {
+		t.Fatal("reserved game not deleted after its formation timeout")
+	}
+}
+
+func TestOpenGames(t *testing.T) {
+	server := newTestServer(t)
+	user := server.token("alice")
+	_, response := server.post(pathCreateGame, user,
+		map[string]interface{}{"appId": "tests", "numPlayers": 3, "public": true, "secret": "open sesame"})
+	reserved, _ := response["gameToken"].(string)
+	server.post(pathCreateGame, user, map[string]interface{}{"appId": "tests", "numPlayers": 2})
+	server.post(pathCreateGame, user, map[string]interface{}{"appId": "others", "numPlayers": 2, "public": true})
+	advance(time.Minute)
+	public := joinOptions{query: url.Values{publicKey: {"true"}}}
+	a := server.join("alice", testGame, alice, "2", public)
+	a.expectMessage(playerListType)
+	full := server.join("alice", "tests_fullgame", alice, "1", public)
+	full.expectMessage(playerListType)
+	// A started game is not listed even if it is missing a player
+	started := server.join("alice", "tests_started", alice, "1", public)
+	started.expectMessage(playerListType)
+	admin := server.token("admin", "admin:server")
+	server.post(pathSetNumPlayers, admin, map[string]interface{}{"gameToken": "tests_started", "numPlayers": 2})
+
+	var games []OpenGame
+	status := server.postDecode(pathOpenGames, user, map[string]string{"appId": "tests"}, &games)
+	if status != http.StatusOK {
+		t.Fatalf("open games failed: %d", status)
+	}
+	expected := []OpenGame{
+		{GameToken: reserved, NumPlayers: 3, Players: 0, Age: 60, Secret: true},
+		{GameToken: testGame, NumPlayers: 2, Players: 1, Age: 0},
+	}
+	if !slices.Equal(games, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, games)
+	}
+	if status, _ := server.post(pathOpenGames, user, map[string]interface{}{}); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, status)
+	}
+}
+
+// Read the next matchmaking message, failing unless it has the expected status
+func expectMatchStatus(t *testing.T, client *testClient, status string) *matchMessage {
+	t.Helper()
+	var message matchMessage
+	client.readJSON(&message)
+	if message.Status != status {
+		t.Fatalf("expected matchmaking status %q, got %+v", status, message)
+	}
+	return &message
+}
+
+// The number of players waiting in a matchmaking queue
+func waitingPlayers(appId string, numPlayers int) int {
+	matchmaker.mu.Lock()
+	defer matchmaker.mu.Unlock()
+	return len(matchmaker.queues[matchKey{appId, numPlayers}])
+}
+
+func TestMatchmaking(t *testing.T) {
+	server := newTestServer(t)
+	var clients []*testClient
+	for i, name := range []string{"alice", "bob", "carol"} {
+		client := server.matchmake(name, "tests", "3", name)
+		if waiting := expectMatchStatus(t, client, matchWaiting).Waiting; waiting != i+1 {
+			t.Fatalf("expected %d waiting, got %d", i+1, waiting)
+		}
+		clients = append(clients, client)
+	}
+	// A queue for a different number of players is separate
+	other := server.matchmake("dave", "tests", "2", "dave")
+	expectMatchStatus(t, other, matchWaiting)
+
+	var gameToken string
+	var players []*testClient
+	for i, client := range clients {
+		message := expectMatchStatus(t, client, matchFound)
+		if gameToken == "" {
+			gameToken = message.GameToken
+		}
+		if message.GameToken != gameToken || message.Order != uint32(i+1) ||
+			message.Player != []string{alice, bob, carol}[i] {
+			t.Fatalf("unexpected match %+v", message)
+		}
+		client.expectCloseCode(websocket.CloseNormalClosure)
+		player := server.join([]string{"alice", "bob", "carol"}[i], gameToken, message.Player, "")
+		players = append(players, player)
+	}
+	players[2].expect(playerListType, "3 "+alice+" "+bob+" "+carol)
+	if waitingPlayers("tests", 3) != 0 || waitingPlayers("tests", 2) != 1 {
+		t.Fatal("unexpected queue contents")
+	}
+}
+
+func TestMatchmakingNumPlayersBounds(t *testing.T) {
+	server := newTestServer(t)
+	for _, numPlayers := range []string{"1", strconv.Itoa(maxNumPlayers + 1)} {
+		query := url.Values{appIdKey: {"tests"}, numPlayersKey: {numPlayers}, playerNameKey: {"alice"}}
+		_, response, err := server.dial("alice", pathMatchmake, query, protocolV1)
+		if err == nil || response.StatusCode != http.StatusBadRequest {
+			t.Errorf("numPlayers %s: expected status %d, got %v", numPlayers, http.StatusBadRequest, response)
+		}
+	}
+}
+
+func TestMatchmakingQueueTimeout(t *testing.T) {
+	server := newTestServer(t)
+	a := server.matchmake("alice", "tests", "2", "alice")
+	expectMatchStatus(t, a, matchWaiting)
+	advance(config.GameFormationTimeout)
+	if waitingPlayers("tests", 2) != 1 {
+		t.Fatal("player removed from the queue before the formation timeout")
+	}
+	advance(config.CleanupPeriod)
+	expectMatchStatus(t, a, matchTimeout)
+	a.expectCloseCode(websocket.CloseNormalClosure)
+	if waitingPlayers("tests", 2) != 0 {
+		t.Fatal("player still queued after the formation timeout")
+	}
+}
+
+func TestMatchmakingPlayerLeaves(t *testing.T) {
+	server := newTestServer(t)
+	a := server.matchmake("alice", "tests", "2", "alice")
+	expectMatchStatus(t, a, matchWaiting)
+	a.close()
+	eventually(t, "player to leave the queue", func() bool { return waitingPlayers("tests", 2) == 0 })
+	b := server.matchmake("bob", "tests", "2", "bob")
+	expectMatchStatus(t, b, matchWaiting)
+	c := server.matchmake("carol", "tests", "2", "carol")
+	expectMatchStatus(t, c, matchWaiting)
+	if message := expectMatchStatus(t, b, matchFound); message.Order != 1 {
+		t.Fatalf("unexpected match %+v", message)
+	}
+
+	// Queuing again on another connection replaces the earlier entry
+	d := server.matchmake("dave", "tests", "2", "dave")
+	expectMatchStatus(t, d, matchWaiting)
+	d2 := server.matchmake("dave", "tests", "2", "dave")
+	expectMatchStatus(t, d, matchReplaced)
+	if waiting := expectMatchStatus(t, d2, matchWaiting).Waiting; waiting != 1 {
+		t.Fatalf("expected 1 waiting, got %d", waiting)
+	}
+
+	for _, query := range []url.Values{
+		{appIdKey: {"tests"}, numPlayersKey: {"2"}},
+		{appIdKey: {"Bad App"}, numPlayersKey: {"2"}, playerNameKey: {"eve"}},
+		{appIdKey: {"tests"}, numPlayersKey: {"zero"}, playerNameKey: {"eve"}},
+	} {
+		_, response, err := server.dial("eve", pathMatchmake, query, protocolV1)
+		if err == nil || response.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected status %d, got %v", query, http.StatusBadRequest, response)
+		}
+	}
+}
+
+func TestJoinValidation(t *testing.T) {
+	server := newTestServer(t)
+	_, response, err := server.tryJoin("alice", testGame, "YWxpY2U=:0", "2")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidOrder)
+	_, response, err = server.tryJoin("carol", testGame, carol, "2")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidOrder)
+	_, response, err = server.tryJoin("alice", testGame, alice, strconv.Itoa(maxNumPlayers+1))
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidNumPlayers)
+	_, response, err = server.tryJoin("alice", testGame, "YWxpY2U=:"+strconv.Itoa(maxNumPlayers+1), "")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidOrder)
+	if registry.count() != 0 {
+		t.Fatal("a rejected join created a game")
+	}
+
+	a := server.join("alice", testGame, alice, "2")
+	a.expectMessage(playerListType)
+	_, response, err = server.tryJoin("bob", testGame, bob, "3")
+	expectRejected(t, response, err, http.StatusConflict, errCodeNumPlayersMismatch)
+	_, response, err = server.tryJoin("carol", testGame, carol, "")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidOrder)
+	b := server.join("bob", testGame, bob, "2")
+	b.expectMessage(playerListType)
+
+	// Once an admin lowers the number of players, a vacated place cannot be taken
+	admin := server.token("admin", "admin:server")
+	server.post(pathKickPlayer, admin, map[string]interface{}{"gameToken": testGame, "player": 2})
+	server.post(pathSetNumPlayers, admin, map[string]interface{}{"gameToken": testGame, "numPlayers": 1})
+	_, response, err = server.tryJoin("bob", testGame, "Ym9i:1", "")
+	expectRejected(t, response, err, http.StatusForbidden, errCodePlayerTaken)
+	_, response, err = server.tryJoin("bob", testGame, bob, "")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidOrder)
+	a = server.join("alice", testGame, alice, "1")
+	a.expectMessage(playerListType)
+}
+
+func TestLateNumPlayers(t *testing.T) {
+	server := newTestServer(t)
+	c := server.join("carol", testGame, carol, "")
+	c.expect(playerListType, "0 "+carol)
+	_, response, err := server.tryJoin("alice", testGame, alice, "2")
+	expectRejected(t, response, err, http.StatusConflict, errCodeNumPlayersMismatch)
+	a := server.join("alice", testGame, alice, "3")
+	a.expect(playerListType, "3 "+alice+" "+carol)
+	b := server.join("bob", testGame, bob, "")
+	b.expect(playerListType, "3 "+alice+" "+bob+" "+carol)
+}
+
+func TestJoinFullGame(t *testing.T) {
+	server := newTestServer(t)
+	// Players 1 and 3 fill a game saved for 2 players, which an admin can no longer set up
+	registry.restore(map[string]*SavedGame{testGame: {NumPlayers: 2, Players: map[uint32]*SavedPlayer{
+		1: {Token: alice, Subject: "alice"}, 3: {Token: carol, Subject: "carol"}}}})
+	_, response, err := server.tryJoin("bob", testGame, bob, "")
+	expectRejected(t, response, err, http.StatusConflict, errCodeGameFull)
+	a := server.join("alice", testGame, alice, "")
+	a.expectMessage(playerListType)
+}
+
+func TestPlayerEndsGame(t *testing.T) {
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	s := server.spectate("sam", testGame, "sam", v2)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	s.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.expect(startedType, "")
+	s.expect(startedType, "")
+	if phase := registry.lookup(testGame).Phase; phase != phaseStarted {
+		t.Fatalf("expected phase %s, got %s", phaseStarted, phase)
+	}
+
+	b.send(endedType, "")
+	b.expect(errorType, "Only the leader may end the game")
+	a.send(endedType, "")
+	for _, client := range []*testClient{a, b, s} {
+		client.expect(endedType, phaseFinished)
+		client.expectCloseCode(websocket.CloseNormalClosure)
+	}
+	if registry.lookup(testGame) != nil {
+		t.Fatal("finished game not removed")
+	}
+}
+
+func TestGameEndedBeforeStart(t *testing.T) {
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "3", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	a.send(endedType, "")
+	a.expect(endedType, phaseAbandoned)
+	b.expect(endedType, phaseAbandoned)
+	b.expectCloseCode(websocket.CloseNormalClosure)
+}
+
+func TestLeaderElection(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	leader := joinOptions{protocol: protocolV2, leader: true}
+	a := server.join("alice", testGame, alice, "3", leader)
+	a.expect(playerListType, "3 "+alice)
+	a.expect(leaderType, "1")
+	b := server.join("bob", testGame, bob, "", leader)
+	b.expect(leaderType, "1")
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	s := server.spectate("sam", testGame, "sam", leader)
+	s.expect(leaderType, "1")
+
+	// The leader keeps the role while it may still reconnect
+	a.close()
+	b.expect(disconnectedType, alice)
+	s.expect(disconnectedType, alice)
+	advance(config.ReconnectGrace - config.CleanupPeriod)
+	if game := registry.lookup(testGame); game.Leader != 1 {
+		t.Fatalf("expected leader 1 before the grace expired, got %d", game.Leader)
+	}
+	advance(config.CleanupPeriod)
+	b.expect(lostPlayerType, alice)
+	b.expect(leaderType, "2")
+	s.expect(lostPlayerType, alice)
+	s.expect(leaderType, "2")
+
+	// The old leader regains leadership on returning, having the lowest order number
+	a = server.join("alice", testGame, alice, "", leader)
+	a.expect(leaderType, "2")
+	a.expectMessage(playerListType)
+	a.expect(leaderType, "1")
+	b.expectMessage(playerListType)
+	b.expect(leaderType, "1")
+	b.expectNothing()
+}
+
+func TestLowestOrderBecomesLeader(t *testing.T) {
+	server := newTestServer(t)
+	leader := joinOptions{protocol: protocolV2, leader: true}
+	b := server.join("bob", testGame, bob, "2", leader)
+	b.expect(playerListType, "2 "+bob)
+	b.expect(leaderType, "2")
+	a := server.join("alice", testGame, alice, "", leader)
+	a.expect(leaderType, "2")
+	a.expectMessage(playerListType)
+	a.expect(leaderType, "1")
+	a.expect(startedType, "")
+	b.expectMessage(playerListType)
+	b.expect(leaderType, "1")
+	b.expect(startedType, "")
+
+	// Only the new leader may end the game
+	b.send(endedType, "")
+	b.expect(errorType, "Only the leader may end the game")
+	a.send(endedType, "")
+	a.expect(endedType, phaseFinished)
+	b.expect(endedType, phaseFinished)
+}
+
+func TestLeaderReconnectionKeepsLeadership(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	leader := joinOptions{protocol: protocolV2, leader: true}
+	a := server.join("alice", testGame, alice, "2", leader)
+	a.expectMessage(playerListType)
+	a.expect(leaderType, "1")
+	b := server.join("bob", testGame, bob, "", leader)
+	b.expect(leaderType, "1")
+	b.expectMessage(playerListType)
+	b.expect(startedType, "")
+
+	// A new connection for the leader replaces the old one without an election
+	a = server.join("alice", testGame, alice, "", leader)
+	b.expectMessage(playerListType)
+
+	// So does reconnection within the grace period
+	a.close()
+	b.expect(disconnectedType, alice)
+	server.join("alice", testGame, alice, "", leader)
+	b.expect(reconnectedType, alice)
+	b.expectNothing()
+	if game := registry.lookup(testGame); game.Leader != 1 {
+		t.Fatalf("expected leader 1, got %d", game.Leader)
+	}
+}
+
+func TestIdleLeaderReplaced(t *testing.T) {
+	server := newTestServer(t)
+	leader := joinOptions{protocol: protocolV2, leader: true}
+	a := server.join("alice", testGame, alice, "2", leader)
+	a.expectMessage(playerListType)
+	a.expect(leaderType, "1")
+	b := server.join("bob", testGame, bob, "", leader)
+	b.expect(leaderType, "1")
+	b.expectMessage(playerListType)
+	b.expect(startedType, "")
+	// Only bob answers pings, so only alice times out
+	player := registry.lookup(testGame).Players[2]
+	for elapsed := time.Duration(0); elapsed <= config.PlayerTimeout; elapsed += config.CleanupPeriod {
+		registry.markActive(player)
+		advance(config.CleanupPeriod)
+	}
+	a.expectClosed()
+	b.expect(lostPlayerType, alice)
+	b.expect(leaderType, "2")
+}
+
+func TestResumeSession(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.expect(startedType, "")
+	if b.resumeToken == "" {
+		t.Fatal("no resume token issued")
+	}
+
+	a.send(gameStateType, "state1")
+	a.expect(gameStateType, "state1")
+	state := b.expectMessage(gameStateType)
+	b.send(ackType, strconv.FormatUint(state.env.Seq, 10))
+	b.close()
+	a.expect(disconnectedType, bob)
+	a.send(chatType, "hi")
+	a.send(gameStateType, "state2")
+	a.expect(chatType, "hi")
+	a.expect(gameStateType, "state2")
+
+	// Exactly the messages after the acknowledged one are resent, then the resumption proceeds as a reconnection
+	b, response, err := server.tryResume("bob", b.resumeToken, v2)
+	if err != nil {
+		t.Fatalf("could not resume: %v (response %v)", err, response)
+	}
+	first := b.expectMessage(disconnectedType)
+	if first.env.Seq != state.env.Seq+1 {
+		t.Fatalf("expected resend to start at %d, got %d", state.env.Seq+1, first.env.Seq)
+	}
+	b.expect(chatType, "hi")
+	b.expect(gameStateType, "state2")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	b.expect(reconnectedType, bob)
+	a.expect(reconnectedType, bob)
+}
+
+func TestResumeWithoutAck(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	b.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.expect(startedType, "")
+	a.send(gameStateType, "state1")
+	a.expect(gameStateType, "state1")
+	b.expect(gameStateType, "state1")
+	b.close()
+	a.expect(disconnectedType, bob)
+	a.send(gameStateType, "state2")
+	a.expect(gameStateType, "state2")
+
+	// Having acknowledged nothing, the player gets the usual replay rather than the whole history
+	b, response, err := server.tryResume("bob", b.resumeToken, v2)
+	if err != nil {
+		t.Fatalf("could not resume: %v (response %v)", err, response)
+	}
+	b.expect(gameStateType, "state2")
+	b.expect(startedType, "")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	b.expect(reconnectedType, bob)
+	a.expect(reconnectedType, bob)
+}
+
+func TestResumeAfterHistoryOverflow(t *testing.T) {
+	setReconnectGrace(t, 30*time.Second)
+	server := newTestServer(t)
+	v2 := joinOptions{protocol: protocolV2}
+	a := server.join("alice", testGame, alice, "2", v2)
+	a.expectMessage(playerListType)
+	b := server.join("bob", testGame, bob, "", v2)
+	a.expectMessage(playerListType)
+	a.expect(startedType, "")
+	b.expectMessage(playerListType)
+	started := b.expectMessage(startedType)
+	b.send(ackType, strconv.FormatUint(started.env.Seq, 10))
+	token := b.resumeToken
+	b.close()
+	a.expect(disconnectedType, bob)
+	for i := 0; i <= resumeHistorySize; i++ {
+		a.send(gameStateType, strconv.Itoa(i))
+		a.expect(gameStateType, strconv.Itoa(i))
+	}
+
+	// Too much was missed to resend, so the usual replay is sent instead
+	b, response, err := server.tryResume("bob", token, v2)
+	if err != nil {
+		t.Fatalf("could not resume: %v (response %v)", err, response)
+	}
+	b.expect(gameStateType, strconv.Itoa(resumeHistorySize))
+	b.expect(startedType, "")
+	b.expect(playerListType, "2 "+alice+" "+bob)
+	b.expect(reconnectedType, bob)
+}
+
+func TestResumeTokenRejected(t *testing.T) {
+	server := newTestServer(t)
+	a := server.join("alice", testGame, alice, "2", joinOptions{protocol: protocolV2})
+	a.expectMessage(playerListType)
+	token := a.resumeToken
+
+	_, response, err := server.tryResume("alice", token[:len(token)-2]+"xx")
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidResumeToken)
+	_, response, err = server.tryResume("bob", token)
+	expectRejected(t, response, err, http.StatusForbidden, errCodeInvalidResumeToken)
+	registry.endGame(testGame, phaseAbandoned)
+	_, response, err = server.tryResume("alice", token)
+	expectRejected(t, response, err, http.StatusNotFound, errCodeNoSuchGame)
+	advance(resumeTokenLifetime)
+	_, response, err = server.tryResume("alice", token)
+	expectRejected(t, response, err, http.StatusBadRequest, errCodeInvalidResumeToken)
+}
+
+func TestRestoredPlayerWithoutSubjectClaimed(t *testing.T) {
+	server := newTestServer(t)
+	registry.restore(map[string]*SavedGame{testGame: {NumPlayers: 2,
+		Players: map[uint32]*SavedPlayer{1: {Token: alice}}}})
+	a := server.join("alice", testGame, alice, "")
+	a.expectMessage(playerListType)
+	_, response, err := server.tryJoin("mallory", testGame, alice, "")
+	expectRejected(t, response, err, http.StatusForbidden, errCodePlayerTaken)
+}
@@ -0,0 +1,101 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Leadership of a game.  Each game has a designated leader, one of its connected players, on whom the
+// apps rely for tasks such as setting up the game.  The leader is the connected player with the lowest
+// order number: it is elected when a player with a lower order than the leader's connects, and when the
+// leader is lost (see reconnect.go) or removed from the game.  Each new leader is announced to everyone with 'H'
+// followed by its order number.
+
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"golang.org/x/exp/maps"
+)
+
+// Whether a player has a live client.  The registry lock must be held.
+func isConnected(player *Player) bool {
+	return player != nil && player.Client != nil && !player.Client.terminated.Load()
+}
+
+// Elect a leader when a player connects to a game that has none (because the game is new or because no
+// player was connected when the last leader was lost) or whose leader has a higher order.  Does nothing
+// unless the client is still the player's.  Returns the new leader and whether the leader changed.
+func (r *GameRegistry) claimLeadership(game *Game, client *Client) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	player := game.Players[client.order]
+	if game.Leader != 0 && game.Leader <= client.order {
+		return 0, false
+	}
+	if player != client.player || player.Client != client || client.terminated.Load() {
+		return 0, false
+	}
+	previous := game.Leader
+	leader := electLeader(game)
+	return leader, leader != previous
+}
+
+// Whether a client is that of its game's leader
+func (r *GameRegistry) isLeader(game *Game, client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	player := game.Players[client.order]
+	return game.Leader == client.order && player != nil && player.Client == client
+}
+
+// Elect a new leader if a player lost along with its client was the leader.  A player that has already
+// reconnected with a new client remains the leader.  Returns the new leader (0 if no player is
+// connected) and whether there was an election.
+func (r *GameRegistry) leaderLost(game *Game, client *Client) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if game.Leader != client.order {
+		return 0, false
+	}
+	if player := game.Players[client.order]; player != nil && player.Client != client {
+		return 0, false
+	}
+	return electLeader(game), true
+}
+
+// Subroutine to make the connected player with the lowest order number the leader of a game, or to leave
+// it without a leader if no player is connected.  Returns the new leader.  The registry lock must be held.
+func electLeader(game *Game) uint32 {
+	orders := maps.Keys(game.Players)
+	slices.Sort(orders)
+	game.Leader = 0
+	for _, order := range orders {
+		if isConnected(game.Players[order]) {
+			game.Leader = order
+			break
+		}
+	}
+	slog.Info("Leader elected", logKeyGameToken, game.Hub.gameToken, "leader", game.Leader)
+	return game.Leader
+}
+
+// Announce a new leader to everyone.  Nothing is announced when a game is left without a leader.
+func (h *Hub) announceLeader(leader uint32) {
+	if leader != 0 {
+		h.broadcastMessage(leaderType, []byte(strconv.FormatUint(uint64(leader), 10)))
+	}
+}
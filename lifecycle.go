@@ -0,0 +1,85 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The lifecycle of a game.  A game is forming until its player list is first complete, when it is
+// started and everyone is sent 'S'.  It ends either finished, when a player sends 'F', or abandoned,
+// when it is deleted for lack of players or by an admin (or a player ends it before it started).  On
+// ending, everyone is sent 'F' with the final phase as body, then their connections are closed.
+
+package main
+
+import (
+	"log/slog"
+)
+
+// Game phases
+const (
+	phaseForming   = "forming"
+	phaseStarted   = "started"
+	phaseFinished  = "finished"
+	phaseAbandoned = "abandoned"
+)
+
+// Mark a forming game as started if its player list is complete, announcing the start.  Returns true
+// if the game was started by this call.
+func (r *GameRegistry) startIfComplete(game *Game) bool {
+	r.mu.Lock()
+	started := game.Phase == phaseForming && isComplete(game)
+	if started {
+		game.Phase = phaseStarted
+	}
+	r.mu.Unlock()
+	if started {
+		slog.Info("Game started", logKeyGameToken, game.Hub.gameToken)
+		game.Hub.broadcastMessage(startedType, nil)
+	}
+	return started
+}
+
+// Whether a game has all its players.  The registry lock must be held.
+func isComplete(game *Game) bool {
+	return game.NumPlayers > 0 && len(game.Players) >= game.NumPlayers
+}
+
+// End a game and remove it from the registry.  A game that had not started is abandoned rather than
+// finished.  Returns false if there was no such game.
+func (r *GameRegistry) endGame(gameToken string, phase string) bool {
+	r.mu.Lock()
+	game := r.games[gameToken]
+	if game != nil {
+		delete(r.games, gameToken)
+		if game.Phase == phaseForming {
+			phase = phaseAbandoned
+		}
+		game.Phase = phase
+	}
+	r.mu.Unlock()
+	if game == nil {
+		return false
+	}
+	slog.Info("Game ended", logKeyGameToken, gameToken, "phase", phase)
+	logStoreError(store.RecordRemoveGame(gameToken))
+	game.Hub.end(phase)
+	return true
+}
+
+// Tell the clients how the game ended and stop the hub.  Each client's connection is closed once it
+// has been sent the message.
+func (h *Hub) end(phase string) {
+	h.broadcastMessage(endedType, []byte(phase))
+	h.stop()
+}
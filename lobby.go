@@ -0,0 +1,162 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Lobby functions, which let players create games without having to agree on a game token by other
+// means.  Like the admin functions, these are POST requests with JSON bodies, but they are open to any
+// authenticated user.
+
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Set up the handlers for the lobby functions
+func setupLobbyHandlers(mux *http.ServeMux) {
+	// Create a game for an app with a declared number of players.  The optional fields enforceTurns,
+	// secret and public have the same meaning as the corresponding query values of the websocket.
+	mux.Handle(pathCreateGame, EnsureValidToken()(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := screenRequest(w, r)
+			if body == nil {
+				return
+			}
+			appId, _ := (*body)["appId"].(string)
+			if !isValidAppId(appId) {
+				indicateError(http.StatusBadRequest, "Missing or invalid appId", w)
+				return
+			}
+			numPlayers, ok := getNumberField(*body, "numPlayers")
+			if !ok || numPlayers < 1 || numPlayers > maxNumPlayers {
+				indicateError(http.StatusBadRequest, "Missing or invalid numPlayers", w)
+				return
+			}
+			var options GameOptions
+			options.EnforceTurns, _ = (*body)["enforceTurns"].(bool)
+			options.Secret, _ = (*body)["secret"].(string)
+			options.Public, _ = (*body)["public"].(bool)
+			subject := getClaims(r).RegisteredClaims.Subject
+			gameToken, code, ok := registry.createGame(appId, numPlayers, options, subject)
+			if !ok {
+				indicateCodedError(http.StatusTooManyRequests, errCodeTooManyReservations,
+					"Too many reserved games that nobody has joined", w)
+				return
+			}
+			requestLogger(r).Info("Lobby created game", logKeyGameToken, gameToken, "numPlayers", numPlayers)
+			writeJSON(w, map[string]interface{}{"gameToken": gameToken, "code": code, "numPlayers": numPlayers})
+		}),
+	))
+
+	// List the public games of an app that are still forming
+	mux.Handle(pathOpenGames, EnsureValidToken()(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := screenRequest(w, r)
+			if body == nil {
+				return
+			}
+			appId, _ := (*body)["appId"].(string)
+			if !isValidAppId(appId) {
+				indicateError(http.StatusBadRequest, "Missing or invalid appId", w)
+				return
+			}
+			writeJSON(w, registry.openGames(appId))
+		}),
+	))
+}
+
+// Description of a public game that is waiting for players, as returned by openGames
+type OpenGame struct {
+	GameToken  string `json:"gameToken"`
+	NumPlayers int    `json:"numPlayers"` // Expected number of players (0 if not yet known)
+	Players    int    `json:"players"`    // Number of players that have joined
+	Age        int    `json:"age"`        // Seconds since the game was created
+	Secret     bool   `json:"secret"`     // Whether joining requires a secret
+}
+
+// List the public, still forming, games of an app, oldest first
+func (r *GameRegistry) openGames(appId string) []OpenGame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clock.Now()
+	ans := []OpenGame{}
+	for gameToken, game := range r.games {
+		if !game.Public || game.Phase != phaseForming || !strings.HasPrefix(gameToken, appId+"_") {
+			continue
+		}
+		if game.NumPlayers != 0 && len(game.Players) >= game.NumPlayers {
+			continue
+		}
+		ans = append(ans, OpenGame{GameToken: gameToken, NumPlayers: game.NumPlayers, Players: len(game.Players),
+			Age: int(now.Sub(game.Created).Seconds()), Secret: game.Secret != nil})
+	}
+	slices.SortFunc(ans, func(a, b OpenGame) int {
+		if a.Age != b.Age {
+			return b.Age - a.Age
+		}
+		return strings.Compare(a.GameToken, b.GameToken)
+	})
+	return ans
+}
+
+// Create a reserved game for an app under a new join code on behalf of a user (the subject, or "" for the
+// server itself).  Returns the game token (the appId and the code separated by an underscore) and the code,
+// or false if the user already has maxReservationsPerUser reserved games.  Reserved games are not persisted
+// until a player joins.
+func (r *GameRegistry) createGame(appId string, numPlayers int, options GameOptions, subject string) (string,
+	string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if subject != "" && r.reservations(subject) >= maxReservationsPerUser {
+		return "", "", false
+	}
+	for {
+		code := newJoinCode()
+		gameToken := appId + "_" + code
+		if r.games[gameToken] == nil {
+			game := r.addGame(gameToken, numPlayers, options)
+			game.Reserved = true
+			game.Reserver = subject
+			return gameToken, code, true
+		}
+	}
+}
+
+// Count the games reserved by a user that are still waiting for their first player.  The caller holds the lock.
+func (r *GameRegistry) reservations(subject string) int {
+	count := 0
+	for _, game := range r.games {
+		if game.Reserved && game.Reserver == subject {
+			count++
+		}
+	}
+	return count
+}
+
+// Generate a random join code
+func newJoinCode() string {
+	code := make([]byte, joinCodeLen)
+	limit := big.NewInt(int64(len(joinCodeAlphabet)))
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, limit)
+		code[i] = joinCodeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
@@ -0,0 +1,86 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Structured logging setup.  The level is set by LOG_LEVEL (debug, info, warn or error; default info)
+// and the format by LOG_FORMAT (text or json; default text).  Log records use consistent keys for
+// the game token, player token, remote address and request id.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Keys used for structured log fields
+const (
+	logKeyGameToken  = "gameToken"
+	logKeyPlayer     = "player"
+	logKeySpectator  = "spectator"
+	logKeyRemoteAddr = "remoteAddr"
+	logKeyRequestID  = "requestId"
+)
+
+// Header in which the request id is returned to the client
+const requestIDHeader = "X-Request-Id"
+
+// Context key for the request id
+type requestIDKey struct{}
+
+// Configure the default logger from the environment
+func setupLogging() {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Middleware that assigns each request a random id, recording it in the request context and
+// returning it to the client in the X-Request-Id header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes := make([]byte, 8)
+		rand.Read(bytes)
+		id := hex.EncodeToString(bytes)
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Get a logger carrying the request id and remote address of a request
+func requestLogger(r *http.Request) *slog.Logger {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return slog.With(logKeyRequestID, id, logKeyRemoteAddr, r.RemoteAddr)
+}
@@ -21,70 +21,126 @@ package main
 
 import (
 	"fmt"
-
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 // Main entry point
 func main() {
-	// Check environment variables
-	domainMissing := os.Getenv("AUTH0_DOMAIN") == ""
-	audienceMissing := os.Getenv("AUTH0_AUDIENCE") == ""
-	if domainMissing || audienceMissing {
-		fmt.Println("One or more environment variables were not set")
-		if domainMissing {
-			fmt.Println("AUTH0_DOMAIN is missing")
-		}
-		if audienceMissing {
-			fmt.Println("AUTH0_AUDIENCE is missing")
+	setupLogging()
+
+	// Developer subcommand to mint tokens for the hs256 backend
+	if len(os.Args) > 1 && os.Args[1] == "mint-token" {
+		if err := mintTokenCommand(os.Args[2:]); err != nil {
+			slog.Error("mint-token failed", "error", err)
+			os.Exit(1)
 		}
 		return
 	}
 
-	// Set up handlers
+	// Read the server settings from the environment and command line
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid server settings", "error", err)
+		return
+	}
+
+	// Set up token validation from the environment
+	authConfig, err := loadAuthConfig()
+	if err == nil {
+		err = setupTokenValidation(authConfig)
+	}
+	if err != nil {
+		slog.Error("Token validation is not configured", "error", err)
+		return
+	}
+
+	// Reload any games saved by a previous run
+	store, err = openGameStore()
+	if err != nil {
+		slog.Error("Failed to open the game store", "error", err)
+		return
+	}
+	saved, err := store.Load()
+	if err != nil {
+		slog.Error("Failed to load saved games", "error", err)
+		return
+	}
+	registry.restore(saved)
+
+	// Bind to port address
+	bindAddr := fmt.Sprintf(":%s", config.Port)
+	slog.Info("Server listening", "address", bindAddr)
+
+	// Start cleanup ticker
+	stopCleanup := startCleanupTicker()
+
+	// Start serving requests, until the server fails or the platform asks it to stop
+	server := &http.Server{Addr: bindAddr, Handler: newHandler()}
+	stopping := make(chan os.Signal, 1)
+	signal.Notify(stopping, syscall.SIGTERM, os.Interrupt)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case err = <-serverErr:
+		// No reasonable recovery at this point, just exit
+		slog.Error("Server terminated", "error", err)
+	case sig := <-stopping:
+		slog.Info("Shutting down", "signal", sig.String())
+		shutdown(server, stopCleanup)
+	}
+}
+
+// Make the handler tree for the server: all the endpoints, wrapped in request id assignment
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+
 	// Websocket initiation.  This should carry all traffic from the app itself
-	http.Handle(pathWebsocket, EnsureValidToken()(
+	mux.Handle(pathWebsocket, EnsureValidToken()(
 		http.HandlerFunc(newWebSocket),
 	))
 
+	// Matchmaking, which finds other players and a game to join
+	mux.Handle(pathMatchmake, EnsureValidToken()(
+		http.HandlerFunc(newMatchmakingSocket),
+	))
+
 	// The Dump feature (requires admin role)
-	http.Handle(pathDump, EnsureValidToken()(
+	mux.Handle(pathDump, EnsureValidToken()(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if body := screenRequest(w, r); body != nil {
 				if isAdmin(w, r) {
-					dump(w)
+					registry.dump(w)
 				}
 			}
 		}),
 	))
 
 	// The Reset feature (requires admin role)
-	http.Handle(pathReset, EnsureValidToken()(
+	mux.Handle(pathReset, EnsureValidToken()(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if body := screenRequest(w, r); body != nil {
 				if isAdmin(w, r) {
-					reset()
+					registry.reset()
 				}
 			}
 		}),
 	))
 
-	// Permit port override (default 80)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
-	}
+	// Metrics in Prometheus format (unauthenticated, for scraping)
+	mux.HandleFunc(pathMetrics, serveMetrics)
 
-	// Bind to port address
-	bindAddr := fmt.Sprintf(":%s", port)
-	fmt.Printf("==> Server listening at %s\n", bindAddr)
+	// The admin functions on individual games (require admin role)
+	setupAdminHandlers(mux)
 
-	// Start cleanup ticker
-	startCleanupTicker()
+	// The lobby functions, creating and finding games (open to all authenticated users)
+	setupLobbyHandlers(mux)
 
-	// Start serving requests
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
-	// No reasonable recovery at this point, just exit
-	fmt.Println(err)
+	return withRequestID(mux)
 }
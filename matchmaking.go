@@ -0,0 +1,254 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Automatic matchmaking.  A player who just wants a game opens a websocket on /matchmake with the
+// query values AppId, NumPlayers and PlayerName and waits.  Players are queued per appId and number
+// of players; as soon as a queue holds enough players, the server creates a game for them (just as if
+// they had joined it in order) and sends each a JSON message with the game token, its player token and
+// its order number, then closes the matchmaking websocket.  The player then opens /websocket as usual.
+// A player still waiting when the formation timeout expires is told so and disconnected.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Values of the status field of matchmaking messages
+const (
+	matchWaiting   = "waiting"   // Queued; waiting gives the number of players now in the queue
+	matchFound     = "matched"   // A game has been formed; the other fields say how to join it
+	matchTimeout   = "timeout"   // Not enough players arrived in time
+	matchGoingAway = "goingAway" // The server is shutting down
+	matchReplaced  = "replaced"  // The same user queued again on another connection
+)
+
+// A message sent to a waiting player
+type matchMessage struct {
+	Status    string `json:"status"`
+	Waiting   int    `json:"waiting,omitempty"`
+	GameToken string `json:"gameToken,omitempty"`
+	Player    string `json:"player,omitempty"`
+	Order     uint32 `json:"order,omitempty"`
+}
+
+// The queues are kept per app and number of players
+type matchKey struct {
+	appId      string
+	numPlayers int
+}
+
+// A player waiting in a queue
+type matchEntry struct {
+	key      matchKey
+	subject  string
+	name     string
+	deadline time.Time
+	// Receives the final message for the player.  Buffered so the matchmaker never blocks on it.
+	result chan *matchMessage
+}
+
+// The queues of waiting players
+type Matchmaker struct {
+	mu     sync.Mutex
+	queues map[matchKey][]*matchEntry
+}
+
+// The single matchmaker used by the server
+var matchmaker = &Matchmaker{queues: make(map[matchKey][]*matchEntry)}
+
+// Handler for the matchmaking websocket
+func newMatchmakingSocket(w http.ResponseWriter, r *http.Request) {
+	appId := getQueryValue(r, appIdKey)
+	name := getQueryValue(r, playerNameKey)
+	log := requestLogger(r).With("appId", appId, "playerName", name)
+	log.Info("newMatchmakingSocket")
+	if shuttingDown.Load() {
+		indicateError(http.StatusServiceUnavailable, "Server is shutting down", w)
+		return
+	}
+	if !isValidAppId(appId) {
+		indicateError(http.StatusBadRequest, "Missing or invalid appId", w)
+		return
+	}
+	if name == "" || len(name) > maxPlayerNameLen {
+		indicateError(http.StatusBadRequest, "Missing or invalid player name", w)
+		return
+	}
+	numPlayers, err := strconv.Atoi(getQueryValue(r, numPlayersKey))
+	if err != nil || numPlayers < 2 || numPlayers > maxNumPlayers {
+		indicateError(http.StatusBadRequest, "Missing or invalid value for numPlayers", w)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("Websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	entry := &matchEntry{key: matchKey{appId, numPlayers}, subject: getClaims(r).RegisteredClaims.Subject,
+		name: name, deadline: clock.Now().Add(config.GameFormationTimeout), result: make(chan *matchMessage, 1)}
+	waiting := matchmaker.enqueue(entry)
+	log.Info("Player queued for matchmaking", "numPlayers", numPlayers, "waiting", waiting)
+	if !writeMatchMessage(conn, &matchMessage{Status: matchWaiting, Waiting: waiting}) {
+		matchmaker.leave(entry)
+		return
+	}
+	// This goroutine is the only writer.  A reader goroutine notices if the player goes away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case result := <-entry.result:
+		log.Info("Matchmaking finished", "status", result.Status, logKeyGameToken, result.GameToken)
+		closeCode, reason := websocket.CloseNormalClosure, ""
+		if result.Status == matchGoingAway {
+			closeCode, reason = websocket.CloseGoingAway, goingAwayReason
+		}
+		if writeMatchMessage(conn, result) {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason),
+				time.Now().Add(writeWait))
+		}
+	case <-gone:
+		log.Info("Player left the matchmaking queue")
+		matchmaker.leave(entry)
+	}
+}
+
+// Send a matchmaking message as a JSON text frame, returning false if the connection failed
+func writeMatchMessage(conn *websocket.Conn, message *matchMessage) bool {
+	encoded, _ := json.Marshal(message)
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, encoded) == nil
+}
+
+// Add a player to its queue, replacing any earlier entry of the same user, and form a game if the queue
+// is full.  Returns the number of players in the queue (including this one) before any game is formed.
+func (m *Matchmaker) enqueue(entry *matchEntry) int {
+	m.mu.Lock()
+	queue := m.queues[entry.key]
+	for i, other := range queue {
+		if other.subject == entry.subject {
+			queue = append(queue[:i], queue[i+1:]...)
+			other.result <- &matchMessage{Status: matchReplaced}
+			break
+		}
+	}
+	queue = append(queue, entry)
+	waiting := len(queue)
+	var matched []*matchEntry
+	if waiting == entry.key.numPlayers {
+		matched = queue
+		delete(m.queues, entry.key)
+	} else {
+		m.queues[entry.key] = queue
+	}
+	m.mu.Unlock()
+	if matched != nil {
+		formGame(entry.key, matched)
+	}
+	return waiting
+}
+
+// Remove a player from its queue (if still there)
+func (m *Matchmaker) leave(entry *matchEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queue := m.queues[entry.key]
+	for i, other := range queue {
+		if other == entry {
+			m.queues[entry.key] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(m.queues[entry.key]) == 0 {
+		delete(m.queues, entry.key)
+	}
+}
+
+// Create a game for a full queue, adding the players in the order they arrived, and tell them about it
+func formGame(key matchKey, entries []*matchEntry) {
+	gameToken, _, _ := registry.createGame(key.appId, key.numPlayers, GameOptions{}, "")
+	var game *Game
+	slog.Info("Matchmaking formed a game", logKeyGameToken, gameToken, "numPlayers", key.numPlayers)
+	for i, entry := range entries {
+		order := uint32(i + 1)
+		playerToken := base64.StdEncoding.EncodeToString([]byte(entry.name)) + ":" + strconv.Itoa(i+1)
+		var err error
+		game, _, err = registry.ensureGameAndPlayer(gameToken, playerToken, order, key.numPlayers, entry.subject,
+			GameOptions{})
+		if err != nil {
+			// Cannot happen for a new game without a secret, but don't leave the player waiting
+			slog.Error("Matchmaking could not add player", logKeyGameToken, gameToken, "error", err)
+			entry.result <- &matchMessage{Status: matchTimeout}
+			continue
+		}
+		entry.result <- &matchMessage{Status: matchFound, GameToken: gameToken, Player: playerToken, Order: order}
+	}
+	if game != nil {
+		// The start is replayed to the players as they connect
+		registry.startIfComplete(game)
+	}
+}
+
+// Time out players who have waited longer than the formation timeout
+func (m *Matchmaker) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clock.Now()
+	for key, queue := range m.queues {
+		remaining := queue[:0]
+		for _, entry := range queue {
+			if now.After(entry.deadline) {
+				entry.result <- &matchMessage{Status: matchTimeout}
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(m.queues, key)
+		} else {
+			m.queues[key] = remaining
+		}
+	}
+}
+
+// Tell all waiting players that the server is going away and empty the queues
+func (m *Matchmaker) shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, queue := range m.queues {
+		for _, entry := range queue {
+			entry.result <- &matchMessage{Status: matchGoingAway}
+		}
+		delete(m.queues, key)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Counters and gauges exposed in the Prometheus text format at /metrics.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Reasons for which cleanup deletes games and players
+const (
+	reasonFormationTimeout = "formation_timeout"
+	reasonIdlePlayer       = "idle_player"
+	reasonEmptyGame        = "empty_game"
+)
+
+var (
+	// Messages relayed by hubs, indexed by message type
+	messagesRelayed [256]atomic.Uint64
+
+	// Bytes of websocket message data received from and sent to clients
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	// Deletions made by cleanup, by reason
+	cleanupDeletions = map[string]*atomic.Uint64{
+		reasonFormationTimeout: new(atomic.Uint64),
+		reasonIdlePlayer:       new(atomic.Uint64),
+		reasonEmptyGame:        new(atomic.Uint64),
+	}
+
+	// Requests rejected because their JWT failed validation
+	jwtFailures atomic.Uint64
+
+	// Joins rejected because they did not present the game's secret
+	joinSecretFailures atomic.Uint64
+
+	// Clients dropped by a hub because their send buffer was full
+	sendOverflows atomic.Uint64
+
+	// Clients currently registered with a hub
+	connectedClients atomic.Int64
+)
+
+// Handler for the metrics endpoint
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "unigame_active_games", "gauge", "Number of games in the registry.")
+	fmt.Fprintf(w, "unigame_active_games %d\n", registry.count())
+
+	writeMetricHeader(w, "unigame_connected_clients", "gauge", "Number of clients registered with a hub.")
+	fmt.Fprintf(w, "unigame_connected_clients %d\n", connectedClients.Load())
+
+	writeMetricHeader(w, "unigame_messages_relayed_total", "counter", "Messages relayed by hubs, by type.")
+	for msgType := range messagesRelayed {
+		if count := messagesRelayed[msgType].Load(); count > 0 {
+			fmt.Fprintf(w, "unigame_messages_relayed_total{type=%q} %d\n", string(rune(msgType)), count)
+		}
+	}
+
+	writeMetricHeader(w, "unigame_received_bytes_total", "counter", "Bytes of message data received from clients.")
+	fmt.Fprintf(w, "unigame_received_bytes_total %d\n", bytesIn.Load())
+
+	writeMetricHeader(w, "unigame_sent_bytes_total", "counter", "Bytes of message data sent to clients.")
+	fmt.Fprintf(w, "unigame_sent_bytes_total %d\n", bytesOut.Load())
+
+	writeMetricHeader(w, "unigame_cleanup_deletions_total", "counter", "Games and players deleted by cleanup, by reason.")
+	for _, reason := range []string{reasonFormationTimeout, reasonIdlePlayer, reasonEmptyGame} {
+		fmt.Fprintf(w, "unigame_cleanup_deletions_total{reason=%q} %d\n", reason, cleanupDeletions[reason].Load())
+	}
+
+	writeMetricHeader(w, "unigame_jwt_validation_failures_total", "counter", "Requests whose JWT failed validation.")
+	fmt.Fprintf(w, "unigame_jwt_validation_failures_total %d\n", jwtFailures.Load())
+
+	writeMetricHeader(w, "unigame_join_secret_failures_total", "counter",
+		"Joins rejected because of a wrong or missing game secret.")
+	fmt.Fprintf(w, "unigame_join_secret_failures_total %d\n", joinSecretFailures.Load())
+
+	writeMetricHeader(w, "unigame_send_buffer_overflows_total", "counter",
+		"Clients dropped because their send buffer was full.")
+	fmt.Fprintf(w, "unigame_send_buffer_overflows_total %d\n", sendOverflows.Load())
+}
+
+// Write the HELP and TYPE lines for a metric
+func writeMetricHeader(w http.ResponseWriter, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
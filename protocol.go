@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Wire formats for websocket messages.
+//
+// Protocol v1 (the default) is a single type byte followed by an opaque body.  Protocol v2 is selected
+// by requesting the websocket subprotocol "unigame.v2" and wraps every message in a JSON envelope that
+// also carries the sender, a per-game sequence number and the server time.  Clients of both versions can
+// share a game, since the hub relays Messages and each client encodes them according to its own version.
+//
+// Targeted messages name their recipients.  In v1 the body starts with a header line: on input, the
+// comma-separated order numbers of the recipients; on output, the sender's player token.  In v2 the
+// recipients are in the "to" field of the envelope.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions and the subprotocol names that select them
+const (
+	protocolV1 = 1
+	protocolV2 = 2
+
+	subprotocolV1 = "unigame.v1"
+	subprotocolV2 = "unigame.v2"
+)
+
+// A message relayed by a hub.  Seq and Time are assigned by the hub when the message is broadcast.
+// Messages are shared by all the clients they are sent to and must not be modified after broadcast.
+type Message struct {
+	Type   byte      // One of the message type constants
+	Body   []byte    // Opaque to the server except as noted for each type
+	Sender string    // Player token of the sender; empty for messages originated by the server
+	Seq    uint64    // Sequence number within the game, starting at 1
+	Time   time.Time // Server time at broadcast
+
+	// For targeted messages, the order numbers of the players that should receive the message.
+	// Nil for messages that go to everyone.
+	Recipients []uint32
+
+	// In protocol v2, a game state may be marked as ending the sender's turn.
+	EndTurn bool
+
+	origin *Client // The client that sent the message, if any, for reporting routing errors
+	only   *Client // If set, the message is an error report for this client alone
+}
+
+// Whether a message type is only sent to v2 clients.  These are the announcements of game phases, leaders,
+// reconnections and resume tokens, which a v1 client, knowing only the original message types, does not get.
+func isV2Only(msgType byte) bool {
+	switch msgType {
+	case startedType, endedType, leaderType, disconnectedType, reconnectedType, resumeTokenType:
+		return true
+	}
+	return false
+}
+
+// The JSON envelope used by protocol v2
+type envelope struct {
+	Version int      `json:"v"`
+	Type    string   `json:"type"`              // A single character, the same as the v1 type byte
+	Sender  string   `json:"sender,omitempty"`  // Ignored on input
+	Seq     uint64   `json:"seq,omitempty"`     // Ignored on input
+	Time    int64    `json:"time,omitempty"`    // Unix milliseconds.  Ignored on input
+	To      []uint32 `json:"to,omitempty"`      // Recipients of a targeted message
+	EndTurn bool     `json:"endTurn,omitempty"` // Marks a game state that ends the sender's turn
+	Body    []byte   `json:"body"`              // base64 encoded
+}
+
+// Determine the protocol version from the negotiated subprotocol of a connection
+func protocolVersion(conn *websocket.Conn) int {
+	if conn.Subprotocol() == subprotocolV2 {
+		return protocolV2
+	}
+	return protocolV1
+}
+
+// Encode a message for the wire, returning the websocket frame type and the data
+func encodeMessage(version int, msg *Message) (int, []byte) {
+	if version == protocolV2 {
+		env := envelope{Version: protocolV2, Type: string(msg.Type), Sender: msg.Sender, Seq: msg.Seq,
+			To: msg.Recipients, EndTurn: msg.EndTurn, Body: msg.Body}
+		if !msg.Time.IsZero() {
+			env.Time = msg.Time.UnixMilli()
+		}
+		encoded, _ := json.Marshal(env) // cannot fail
+		return websocket.TextMessage, encoded
+	}
+	frameType := websocket.BinaryMessage
+	if msg.Type == chatType || msg.Type == errorType {
+		frameType = websocket.TextMessage
+	}
+	data := []byte{msg.Type}
+	if msg.Type == targetedType {
+		data = append(data, msg.Sender+"\n"...)
+	}
+	return frameType, append(data, msg.Body...)
+}
+
+// Decode a message received from the wire.  The sender is not set.
+func decodeMessage(version int, data []byte) (*Message, error) {
+	if version == protocolV2 {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return nil, err
+		}
+		if len(env.Type) != 1 {
+			return nil, errors.New("envelope type must be a single character")
+		}
+		msg := &Message{Type: env.Type[0], Body: env.Body, EndTurn: env.EndTurn && env.Type[0] == gameStateType}
+		if msg.Type == targetedType {
+			if len(env.To) == 0 {
+				return nil, errors.New("targeted message has no recipients")
+			}
+			msg.Recipients = env.To
+		}
+		return msg, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	msg := &Message{Type: data[0], Body: data[1:]}
+	if msg.Type == targetedType {
+		header, body, found := bytes.Cut(msg.Body, []byte{'\n'})
+		if !found {
+			return nil, errors.New("targeted message has no recipient list")
+		}
+		recipients, err := parseRecipients(string(header))
+		if err != nil {
+			return nil, err
+		}
+		msg.Recipients = recipients
+		msg.Body = body
+	}
+	return msg, nil
+}
+
+// Parse a comma-separated list of player order numbers
+func parseRecipients(list string) ([]uint32, error) {
+	var ans []uint32
+	for _, item := range strings.Split(list, ",") {
+		order, err := strconv.ParseUint(strings.TrimSpace(item), 10, 32)
+		if err != nil || order == 0 {
+			return nil, errors.New("invalid recipient list")
+		}
+		ans = append(ans, uint32(order))
+	}
+	return ans, nil
+}
@@ -0,0 +1,69 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Reconnection grace.  A player whose connection is lost is at first only disconnected, and the others
+// are sent 'D' followed by its player token.  A player that reconnects within the configured grace period
+// is restored without a change to the player list: it is sent the usual replay followed by the player
+// list, and everyone is sent 'R' followed by its player token.  Only when the grace period expires, or the
+// player is removed from the game, is the player lost: the others are then sent 'L' and, if the player was
+// the leader, a new leader is elected.  With a grace period of 0, a lost connection means a lost player.
+
+package main
+
+import (
+	"log/slog"
+)
+
+// Player states
+const (
+	playerConnected    = "connected"
+	playerDisconnected = "disconnected"
+	playerLost         = "lost"
+)
+
+// Record that a player's client has been destroyed, returning the resulting player state.  A player that
+// has been removed from the game is lost.  Returns the empty string if the player already has a new client.
+func (r *GameRegistry) disconnect(client *Client) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	player := client.player
+	if client.game.Players[client.order] != player {
+		player.State = playerLost
+		return playerLost
+	}
+	if player.Client != client {
+		return ""
+	}
+	if config.ReconnectGrace == 0 {
+		player.State = playerLost
+		return playerLost
+	}
+	player.State = playerDisconnected
+	player.GraceEnds = clock.Now().Add(config.ReconnectGrace)
+	return playerDisconnected
+}
+
+// Subroutine for cleanup to end the grace period of a disconnected player if it has expired.  Returns true
+// if the player is now lost.  The registry lock must be held.
+func graceExpired(game *Game, player *Player) bool {
+	if player.State != playerDisconnected || clock.Now().Before(player.GraceEnds) {
+		return false
+	}
+	slog.Info("Reconnect grace expired", logKeyGameToken, game.Hub.gameToken, logKeyPlayer, player.Token)
+	player.State = playerLost
+	return true
+}
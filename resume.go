@@ -0,0 +1,191 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Session resume tokens.  On joining, a player is sent 'I' followed by a resume token: an opaque string,
+// signed by the server, naming the game, the player and the user.  The player may later open the
+// websocket with just `ResumeToken=<token>`, with a JWT for the same user, instead of the usual query values.
+// A token expires resumeTokenLifetime after it is issued.  Only v2 clients are sent tokens.
+//
+// Players acknowledge the messages they have processed by sending 'K' followed by the sequence number of
+// the last one (sequence numbers are carried by protocol v2).  Each game keeps its most recent messages in
+// a ring buffer.  A resuming player is resent the messages after its last acknowledged one, if the buffer
+// still holds them all; otherwise, or if it never acknowledged anything, it gets the usual replay of game
+// state, chat and announcements.
+//
+// Tokens are signed with RESUME_SECRET if set.  Otherwise a random key is used, so tokens do not survive
+// a restart of the server.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The contents of a resume token
+type resumeClaims struct {
+	GameToken string `json:"g"`
+	Player    string `json:"p"`
+	Subject   string `json:"s"`
+	Expires   int64  `json:"e"` // Unix seconds
+}
+
+// The key used to sign resume tokens
+var resumeKey = newResumeKey()
+
+// Make the resume token signing key from RESUME_SECRET, or at random if it is not set
+func newResumeKey() []byte {
+	if secret := os.Getenv("RESUME_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		slog.Error("Failed to make the resume token key", "error", err)
+		os.Exit(1)
+	}
+	return key
+}
+
+// Make the resume token for a player of a game, bound to the user that joined as that player
+func newResumeToken(gameToken string, playerToken string, subject string) string {
+	payload, _ := json.Marshal(resumeClaims{GameToken: gameToken, Player: playerToken, Subject: subject,
+		Expires: clock.Now().Add(resumeTokenLifetime).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signResumePayload(encoded))
+}
+
+func signResumePayload(encoded string) []byte {
+	mac := hmac.New(sha256.New, resumeKey)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Check the signature and expiry of a resume token and return its contents
+func parseResumeToken(token string) (*resumeClaims, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errors.New("malformed resume token")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, signResumePayload(encoded)) {
+		return nil, errors.New("invalid resume token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	claims := &resumeClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	if clock.Now().Unix() >= claims.Expires {
+		return nil, errors.New("resume token has expired")
+	}
+	return claims, nil
+}
+
+// Find the game and player named by a resume token presented by a user.  Also returns the sequence
+// number of the last message the player acknowledged.  No game secret is needed, since the token shows
+// that the player was admitted before.
+func (r *GameRegistry) resumePlayer(claims *resumeClaims, subject string) (*Game, *Player, uint64, error) {
+	if claims.Subject != subject {
+		return nil, nil, 0, &joinError{http.StatusForbidden, errCodeInvalidResumeToken,
+			"Resume token belongs to another user"}
+	}
+	playerOrder, ok := isValidPlayer(claims.Player)
+	if !ok {
+		return nil, nil, 0, &joinError{http.StatusBadRequest, errCodeInvalidResumeToken, "Invalid resume token"}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	game := r.games[claims.GameToken]
+	if game == nil {
+		return nil, nil, 0, &joinError{http.StatusNotFound, errCodeNoSuchGame, "Game not found"}
+	}
+	player := game.Players[playerOrder]
+	if player == nil || player.Token != claims.Player || player.Subject != subject {
+		return nil, nil, 0, &joinError{http.StatusNotFound, errCodeNoSuchPlayer,
+			"Player is no longer in the game"}
+	}
+	player.IdleCount = 0
+	return game, player, player.Acked, nil
+}
+
+// Record that a player has processed the messages up to a sequence number.  Acknowledgements never
+// move backward.
+func (r *GameRegistry) acknowledge(player *Player, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq > player.Acked {
+		player.Acked = seq
+	}
+}
+
+// Open a websocket for a player resuming a session with a resume token
+func resumeWebSocket(w http.ResponseWriter, r *http.Request, token string) {
+	claims, err := parseResumeToken(token)
+	if err != nil {
+		requestLogger(r).Warn("Rejecting resume token", "error", err)
+		indicateCodedError(http.StatusBadRequest, errCodeInvalidResumeToken, "Invalid resume token", w)
+		return
+	}
+	log := requestLogger(r).With(logKeyGameToken, claims.GameToken, logKeyPlayer, claims.Player)
+	game, player, acked, err := registry.resumePlayer(claims, getClaims(r).RegisteredClaims.Subject)
+	if err != nil {
+		joinErr := err.(*joinError)
+		indicateCodedError(joinErr.status, joinErr.code, joinErr.msg, w)
+		return
+	}
+	log.Info("Resuming session", "acked", acked)
+	playerOrder, _ := isValidPlayer(player.Token)
+	openPlayerSocket(w, r, game, player, playerOrder, &acked, log)
+}
+
+// Subroutine of the hub's run loop to resend a resuming client the messages after the last one it
+// acknowledged.  Returns false, having sent nothing, if the client never acknowledged a message or the
+// history no longer holds them all.
+func (h *Hub) resend(client *Client, acked uint64) bool {
+	if acked == 0 || acked > h.seq || h.seq-acked > uint64(len(h.history)) {
+		return false
+	}
+	for seq := acked + 1; seq <= h.seq; seq++ {
+		message := h.history[seq%uint64(len(h.history))]
+		if message.Recipients != nil && !slices.Contains(message.Recipients, client.order) {
+			continue
+		}
+		if !client.accepts(message.Type) {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			// The client will get the next broadcast anyway
+			slog.Warn("Send buffer too small to resend missed messages", logKeyGameToken, h.gameToken)
+			return true
+		}
+	}
+	return true
+}
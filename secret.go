@@ -0,0 +1,100 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Optional per-game join secrets.  The player who creates a game may give a secret; every later join
+// of the game (including reconnection) must present the same secret.  Only a salted hash of the secret
+// is kept.  Failed attempts are counted per game and user, and a user who fails too often is refused
+// for the rest of the failure window.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// A salted hash of a join secret
+type SecretHash struct {
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+// Failed secret attempts by one user on one game within the current window
+type secretFailures struct {
+	count int
+	start time.Time
+}
+
+// Hash a secret with a fresh random salt
+func newSecretHash(secret string) *SecretHash {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &SecretHash{Salt: salt, Hash: hashSecret(salt, secret)}
+}
+
+// Test whether a secret is the one that was hashed
+func (h *SecretHash) matches(secret string) bool {
+	return subtle.ConstantTimeCompare(h.Hash, hashSecret(h.Salt, secret)) == 1
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), secret...))
+	return sum[:]
+}
+
+// Check the secret presented by a user joining a game that has one.  The registry lock must be held.
+func (r *GameRegistry) checkSecret(gameToken string, game *Game, subject string, secret string) error {
+	key := gameToken + " " + subject
+	now := clock.Now()
+	failures := r.secretFailures[key]
+	if failures != nil && now.Sub(failures.start) >= secretFailureWindow {
+		delete(r.secretFailures, key)
+		failures = nil
+	}
+	if failures != nil && failures.count >= maxSecretFailures {
+		slog.Warn("Refusing join after too many wrong secrets", logKeyGameToken, gameToken, "subject", subject)
+		return &joinError{http.StatusTooManyRequests, errCodeTooManyAttempts,
+			"Too many failed attempts; try again later"}
+	}
+	if game.Secret.matches(secret) {
+		delete(r.secretFailures, key)
+		return nil
+	}
+	if failures == nil {
+		failures = &secretFailures{start: now}
+		r.secretFailures[key] = failures
+	}
+	failures.count++
+	joinSecretFailures.Add(1)
+	slog.Warn("Rejecting join with wrong secret", logKeyGameToken, gameToken, "subject", subject,
+		"failures", failures.count)
+	return &joinError{http.StatusForbidden, errCodeWrongSecret, "Wrong or missing game secret"}
+}
+
+// Forget failed attempts whose window has passed.  The registry lock must be held.
+func (r *GameRegistry) pruneSecretFailures() {
+	now := clock.Now()
+	for key, failures := range r.secretFailures {
+		if now.Sub(failures.start) >= secretFailureWindow {
+			delete(r.secretFailures, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Graceful shutdown when the platform stops the server (SIGTERM).  New websockets are refused, every
+// client is told the server is going away and its connection closed with CloseGoingAway, and the
+// store is flushed.  The games themselves are kept in the store so that the next run restores them.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Set when shutdown begins
+var shuttingDown atomic.Bool
+
+// How often shutdown checks whether all clients have disconnected
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shut down the server, waiting at most the configured shutdown timeout for clients to disconnect
+func shutdown(server *http.Server, stopCleanup func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	shuttingDown.Store(true)
+	stopCleanup()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP server did not shut down cleanly", "error", err)
+	}
+	matchmaker.shutdown()
+	registry.shutdown(ctx)
+	logStoreError(store.Close())
+	slog.Info("Shutdown complete")
+}
+
+// Tell the clients of all games that the server is going away and wait until they have disconnected
+// or the context is done.  Then destroy any remaining clients and stop the hubs.  Unlike reset, the
+// games are not removed from the store.
+func (r *GameRegistry) shutdown(ctx context.Context) {
+	r.mu.Lock()
+	old := r.games
+	r.games = make(map[string]*Game)
+	r.mu.Unlock()
+	slog.Info("Notifying clients of shutdown", "games", len(old), "clients", connectedClients.Load())
+	for _, game := range old {
+		game.Hub.broadcastMessage(goingAwayType, []byte(goingAwayReason))
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+wait:
+	for connectedClients.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			slog.Warn("Shutdown deadline passed with clients still connected", "clients", connectedClients.Load())
+			break wait
+		case <-ticker.C:
+		}
+	}
+	for _, game := range old {
+		r.shutDownGame(game)
+	}
+}
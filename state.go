@@ -22,9 +22,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"slices"
 	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/exp/maps"
 )
@@ -37,14 +40,56 @@ type Game struct {
 	NumPlayers int `json:"numPlayers"` // The expected number of players for this game
 	// Note: the number of players in the Players map should not exceed NumPlayers but may be less as
 	// players join the game.  A NumPlayers value of 0 means "unknown", which may be case transiently.
-	Hub *Hub // The Websocket "Hub" for the game (not serialized)
+	Hub *Hub `json:"-"` // The Websocket "Hub" for the game (not serialized)
+	// When EnforceTurns is true, only the ActivePlayer may send game states and the server advances the turn.
+	EnforceTurns bool   `json:"enforceTurns"`
+	ActivePlayer uint32 `json:"activePlayer"`
+	// If set, joining requires the secret given by the player who created the game (not serialized)
+	Secret *SecretHash `json:"-"`
+	// A public game is listed among the open games of its app while it is forming
+	Public bool `json:"public"`
+	// When the game was created (or restored, for a game saved by a previous run)
+	Created time.Time `json:"created"`
+	// The game's phase: forming, started, finished or abandoned
+	Phase string `json:"phase"`
+	// The order number of the game's leader, or 0 if it has none
+	Leader uint32 `json:"leader"`
+	// Set for a game created through the lobby until its first player joins.  A reserved game is not
+	// deleted for having no players, only when its formation time runs out.
+	Reserved bool `json:"reserved"`
+	// The JWT subject of the user who reserved the game (not serialized)
+	Reserver string `json:"-"`
+}
+
+// Options given when joining a game.  Apart from Secret, they only matter when the game is created.
+type GameOptions struct {
+	EnforceTurns bool   // Server-side turn enforcement
+	Secret       string // Sets the game's join secret on creation; otherwise checked against it
+	Public       bool   // List the game among the open games of its app while it is forming
 }
 
 // The state of one Player
 type Player struct {
 	Token     string  `json:"token"`     // Player's token (encodes name and order number)
 	IdleCount int     `json:"idleCount"` // Idle count for this player.
-	Client    *Client // The Websocket "client" for the player (not serialized)
+	Subject   string  `json:"subject"`   // The JWT subject of the user who first joined as this player
+	Client    *Client `json:"-"`         // The Websocket "client" for the player (not serialized)
+	// Whether the player is connected, disconnected (within its reconnect grace) or lost (see reconnect.go)
+	State     string    `json:"state"`
+	GraceEnds time.Time `json:"graceEnds"` // When a disconnected player's reconnect grace expires
+	Acked     uint64    `json:"acked"`     // Sequence number of the last message acknowledged (see resume.go)
+}
+
+// An error that prevents a player from joining a game.  Carries the HTTP status and a stable
+// error code for the client as well as a message.
+type joinError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *joinError) Error() string {
+	return e.msg
 }
 
 type DumpedState struct {
@@ -52,13 +97,266 @@ type DumpedState struct {
 	Games          map[string]*Game `json:"games"`
 }
 
-// Map from game tokens to Game structures
-var games = make(map[string]*Game)
+// The registry of all active games.  All access to the games map and to the mutable fields of Game and
+// Player goes through the registry's methods, which serialize it with a single mutex.  The mutex is never
+// held while waiting on a Hub or Client, so that Hub goroutines never contend with the registry.
+type GameRegistry struct {
+	mu             sync.Mutex
+	games          map[string]*Game           // Map from game tokens to Game structures
+	cleanupCounter int                        // Counter for the number of times cleanup has run
+	secretFailures map[string]*secretFailures // Recent wrong secrets, keyed by game token and subject
+}
+
+// The single registry used by the server
+var registry = newGameRegistry()
+
+// Make a new, empty, registry
+func newGameRegistry() *GameRegistry {
+	return &GameRegistry{games: make(map[string]*Game), secretFailures: make(map[string]*secretFailures)}
+}
 
-// Counter for the number of times cleanup has run
-var cleanupCounter int
+// Reconstitute the games saved by a previous run of the server.  The players have no clients until
+// they reconnect, and are subject to the usual idle timeouts if they do not.
+func (r *GameRegistry) restore(saved map[string]*SavedGame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for gameToken, savedGame := range saved {
+		game := &Game{Players: make(map[uint32]*Player), Hub: newHub(gameToken), NumPlayers: savedGame.NumPlayers,
+			Public: savedGame.Public, Created: clock.Now()}
+		game.EnforceTurns = savedGame.EnforceTurns
+		game.ActivePlayer = savedGame.ActivePlayer
+		game.Secret = savedGame.Secret
+		for playerOrder, savedPlayer := range savedGame.Players {
+			game.Players[playerOrder] = &Player{Token: savedPlayer.Token, Subject: savedPlayer.Subject,
+				State: playerLost}
+		}
+		if savedGame.GameState != nil {
+			game.Hub.lastGameState = &Message{Type: gameStateType, Body: savedGame.GameState}
+		}
+		game.Phase = phaseForming
+		if isComplete(game) {
+			game.Phase = phaseStarted
+			game.Hub.started = &Message{Type: startedType}
+		}
+		r.games[gameToken] = game
+		go game.Hub.run()
+		slog.Info("Restored game", logKeyGameToken, gameToken, "players", len(game.Players))
+	}
+}
+
+// Get the number of games
+func (r *GameRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.games)
+}
 
-// Subroutine to make the player list of a game
+// Find the game a spectator wants to watch, checking the game's secret if it has one
+func (r *GameRegistry) admitSpectator(gameToken string, subject string, secret string) (*Game, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	game := r.games[gameToken]
+	if game == nil {
+		return nil, &joinError{http.StatusNotFound, errCodeNoSuchGame, "Game not found"}
+	}
+	if game.Secret != nil {
+		if err := r.checkSecret(gameToken, game, subject, secret); err != nil {
+			return nil, err
+		}
+	}
+	return game, nil
+}
+
+// Look up a game by its token, returning nil if not found
+func (r *GameRegistry) lookup(gameToken string) *Game {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.games[gameToken]
+}
+
+// Given game and player tokens that are syntactically valid but may or may not designate
+// and actual game and player, make sure that the game and player exist and return the
+// Game and Player structures.  A Game will always have a running Hub whether pre-existing or not.
+// A newly created Player may not yet have a Client.  A Player is bound to the JWT subject of the
+// user who first joined as that player; an attempt to join as an existing player with a different
+// subject is rejected with a joinError.  If the game is created, the options are applied to it.
+func (r *GameRegistry) ensureGameAndPlayer(gameToken string, playerToken string, playerOrder uint32,
+	numPlayers int, subject string, options GameOptions) (*Game, *Player, error) {
+	if playerOrder == 0 {
+		return nil, nil, &joinError{http.StatusBadRequest, errCodeInvalidOrder,
+			"Player order number must be at least 1"}
+	}
+	if numPlayers > maxNumPlayers {
+		return nil, nil, &joinError{http.StatusBadRequest, errCodeInvalidNumPlayers,
+			fmt.Sprintf("A game may have at most %d players", maxNumPlayers)}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	game := r.games[gameToken]
+	if game != nil && game.Secret != nil {
+		if err := r.checkSecret(gameToken, game, subject, options.Secret); err != nil {
+			return nil, nil, err
+		}
+	}
+	if game != nil {
+		if player := game.Players[playerOrder]; player != nil && player.Subject != "" && player.Subject != subject {
+			slog.Warn("Rejecting player whose subject does not match", logKeyGameToken, gameToken,
+				logKeyPlayer, playerToken, "subject", subject, "expected", player.Subject)
+			return nil, nil, &joinError{http.StatusForbidden, errCodePlayerTaken,
+				"Player order number is already in use by another user"}
+		}
+		if err := validateJoin(game, playerOrder, numPlayers); err != nil {
+			slog.Warn("Rejecting invalid join", logKeyGameToken, gameToken, logKeyPlayer, playerToken,
+				"numPlayers", numPlayers, "error", err)
+			return nil, nil, err
+		}
+	} else if playerOrder > maxNumPlayers || (numPlayers > 0 && playerOrder > uint32(numPlayers)) {
+		return nil, nil, &joinError{http.StatusBadRequest, errCodeInvalidOrder,
+			"Player order number exceeds the number of players"}
+	}
+	created := game == nil
+	if created {
+		game = r.addGame(gameToken, numPlayers, options)
+		slog.Info("New game created", logKeyGameToken, gameToken)
+	}
+	// The game's settings are persisted along with its first player
+	first := created || game.Reserved
+	if game.NumPlayers == 0 {
+		slog.Info("Number of players set", logKeyGameToken, gameToken, "numPlayers", numPlayers)
+		game.NumPlayers = numPlayers
+	}
+	player := game.Players[playerOrder]
+	if player == nil {
+		player = &Player{Token: playerToken, Subject: subject}
+		game.Players[playerOrder] = player
+		slog.Info("Player added to game", logKeyGameToken, gameToken, logKeyPlayer, playerToken)
+		logStoreError(store.RecordJoin(gameToken, game.NumPlayers, playerOrder, playerToken, subject))
+		if first && game.EnforceTurns {
+			logStoreError(store.RecordTurn(gameToken, game.EnforceTurns, game.ActivePlayer))
+		}
+		if first && game.Secret != nil {
+			logStoreError(store.RecordSecret(gameToken, game.Secret))
+		}
+		if first && game.Public {
+			logStoreError(store.RecordPublic(gameToken))
+		}
+		game.Reserved = false
+	} else {
+		player.IdleCount = 0
+		if player.Subject == "" {
+			// Restored from an older snapshot without subjects; the first to reconnect claims it
+			player.Subject = subject
+			logStoreError(store.RecordJoin(gameToken, game.NumPlayers, playerOrder, player.Token, subject))
+		}
+	}
+	return game, player, nil
+}
+
+// Check that a player joining an existing game agrees with the game's number of players, has an order
+// number within it (and within maxNumPlayers), and is not one too many.  The registry lock must be held.
+func validateJoin(game *Game, playerOrder uint32, numPlayers int) error {
+	if playerOrder > maxNumPlayers {
+		return &joinError{http.StatusBadRequest, errCodeInvalidOrder,
+			"Player order number exceeds the maximum number of players"}
+	}
+	expected := game.NumPlayers
+	if numPlayers != 0 {
+		if expected != 0 && numPlayers != expected {
+			return &joinError{http.StatusConflict, errCodeNumPlayersMismatch,
+				fmt.Sprintf("The game is for %d players, not %d", expected, numPlayers)}
+		}
+		if expected == 0 {
+			// This join sets the number of players, which must leave room for those already present
+			for order := range game.Players {
+				if order > uint32(numPlayers) {
+					return &joinError{http.StatusConflict, errCodeNumPlayersMismatch,
+						fmt.Sprintf("Player %d has already joined a game said to be for %d players", order, numPlayers)}
+				}
+			}
+			expected = numPlayers
+		}
+	}
+	if expected == 0 {
+		return nil
+	}
+	if playerOrder > uint32(expected) {
+		return &joinError{http.StatusBadRequest, errCodeInvalidOrder,
+			"Player order number exceeds the number of players"}
+	}
+	if game.Players[playerOrder] == nil && len(game.Players) >= expected {
+		return &joinError{http.StatusConflict, errCodeGameFull, "The game already has all its players"}
+	}
+	return nil
+}
+
+// Make a new game with the given settings, add it to the registry and start its hub.  The registry
+// lock must be held.
+func (r *GameRegistry) addGame(gameToken string, numPlayers int, options GameOptions) *Game {
+	game := &Game{Players: make(map[uint32]*Player), Hub: newHub(gameToken), NumPlayers: numPlayers,
+		Public: options.Public, Created: clock.Now(), Phase: phaseForming}
+	if options.EnforceTurns {
+		game.EnforceTurns = true
+		game.ActivePlayer = 1
+	}
+	if options.Secret != "" {
+		game.Secret = newSecretHash(options.Secret)
+	}
+	r.games[gameToken] = game
+	go game.Hub.run()
+	return game
+}
+
+// Destroy the clients of a game that has already been removed from the registry and stop its hub.
+// The registry lock must not be held.
+func (r *GameRegistry) shutDownGame(game *Game) {
+	for _, client := range r.clients(game) {
+		client.Destroy()
+	}
+	game.Hub.stop()
+}
+
+// Get the clients currently attached to a game's players
+func (r *GameRegistry) clients(game *Game) []*Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ans []*Client
+	for _, player := range game.Players {
+		if player.Client != nil {
+			ans = append(ans, player.Client)
+		}
+	}
+	return ans
+}
+
+// Install a new Client for a Player, returning the previous Client (if any) so that the caller
+// can destroy it, and whether the player is reconnecting within its grace period.  The player's idle
+// count is reset.
+func (r *GameRegistry) attachClient(player *Player, client *Client) (*Client, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := player.Client
+	resumed := player.State == playerDisconnected
+	player.Client = client
+	player.IdleCount = 0
+	player.State = playerConnected
+	return old, resumed
+}
+
+// Reset the idle count of a player (called when the player's app shows signs of life)
+func (r *GameRegistry) markActive(player *Player) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	player.IdleCount = 0
+}
+
+// Make the player list of a game
+func (r *GameRegistry) playerList(game *Game) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return makePlayerList(game)
+}
+
+// Subroutine to make the player list of a game.  The registry lock must be held.
 func makePlayerList(game *Game) string {
 	keys := maps.Keys(game.Players)
 	slices.Sort(keys)
@@ -74,21 +372,31 @@ func makePlayerList(game *Game) string {
 // Handler for an admin function to dump the entire state of the server.
 // This is an aid during development.  We might need something more sophisticated
 // for observability in the long run.
-func dump(w http.ResponseWriter) {
-	ans := DumpedState{CleanupCounter: cleanupCounter, Games: games}
+func (r *GameRegistry) dump(w http.ResponseWriter) {
+	r.mu.Lock()
+	ans := DumpedState{CleanupCounter: r.cleanupCounter, Games: r.games}
 	encoded, err := json.MarshalIndent(ans, "", "  ")
+	r.mu.Unlock()
 	if err != nil {
 		indicateError(http.StatusInternalServerError, err.Error(), w)
 		return
 	}
-	fmt.Println("dump called")
-	fmt.Println(string(encoded))
+	slog.Info("dump called")
+	slog.Debug("dumped state", "state", string(encoded))
 	w.Write(append(encoded, byte('\n')))
 }
 
 // Handler for an admin function to reset to the empty state
-func reset() {
-	fmt.Println("reset called")
-	games = make(map[string]*Game)
-	cleanupCounter = 0
+func (r *GameRegistry) reset() {
+	slog.Info("reset called")
+	r.mu.Lock()
+	old := r.games
+	r.games = make(map[string]*Game)
+	r.cleanupCounter = 0
+	r.secretFailures = make(map[string]*secretFailures)
+	r.mu.Unlock()
+	for gameToken, game := range old {
+		logStoreError(store.RecordRemoveGame(gameToken))
+		r.shutDownGame(game)
+	}
 }
@@ -0,0 +1,493 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Persistence of game state so that games survive a server restart.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// GameStore records what is needed to reconstitute the games after a restart: the players that have
+// joined each game and the latest game state of each game.  Connections are not persisted; players
+// are expected to reconnect with the same game token and player token.
+type GameStore interface {
+	// Load the games saved by a previous run
+	Load() (map[string]*SavedGame, error)
+	// Record that a player (authenticated as the given JWT subject) has joined a game (creating the game
+	// if necessary)
+	RecordJoin(gameToken string, numPlayers int, playerOrder uint32, playerToken string, subject string) error
+	// Record a change in the expected number of players of a game
+	RecordNumPlayers(gameToken string, numPlayers int) error
+	// Record the turn enforcement setting and active player of a game
+	RecordTurn(gameToken string, enforceTurns bool, activePlayer uint32) error
+	// Record the (hashed) join secret of a game
+	RecordSecret(gameToken string, secret *SecretHash) error
+	// Record that a game is public
+	RecordPublic(gameToken string) error
+	// Record the latest game state (the message body, without the type byte) of a game
+	RecordGameState(gameToken string, state []byte) error
+	// Record that a player has been removed from a game
+	RecordRemovePlayer(gameToken string, playerOrder uint32) error
+	// Record that a game has been deleted
+	RecordRemoveGame(gameToken string) error
+	// Flush and release resources
+	Close() error
+}
+
+// The persistent form of one game
+type SavedGame struct {
+	NumPlayers   int                     `json:"numPlayers"`
+	Players      map[uint32]*SavedPlayer `json:"players"` // keyed by order number
+	GameState    []byte                  `json:"gameState,omitempty"`
+	EnforceTurns bool                    `json:"enforceTurns,omitempty"`
+	ActivePlayer uint32                  `json:"activePlayer,omitempty"`
+	Secret       *SecretHash             `json:"secret,omitempty"`
+	Public       bool                    `json:"public,omitempty"`
+}
+
+// The persistent form of one player
+type SavedPlayer struct {
+	Token   string `json:"token"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// Decode a saved player.  Snapshots written before players were bound to subjects hold just the player
+// token; such players are claimed by the first user to reconnect as them.
+func (p *SavedPlayer) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*p = SavedPlayer{}
+		return json.Unmarshal(data, &p.Token)
+	}
+	type savedPlayer SavedPlayer // without this method
+	return json.Unmarshal(data, (*savedPlayer)(p))
+}
+
+// The store in use by the server.  Replaced in main when persistence is configured.
+var store GameStore = nullStore{}
+
+// Log (but otherwise ignore) a failure to persist something.  The game can continue without persistence.
+func logStoreError(err error) {
+	if err != nil {
+		slog.Error("Failed to persist game state", "error", err)
+	}
+}
+
+// Open the store designated by the environment.  If STATE_DIR is set, a file-backed store in that
+// directory is used, with changes recorded in the background; otherwise nothing is persisted.
+func openGameStore() (GameStore, error) {
+	dir := os.Getenv("STATE_DIR")
+	if dir == "" {
+		return nullStore{}, nil
+	}
+	fileStore, err := newFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedStore(fileStore), nil
+}
+
+// A GameStore that persists nothing
+type nullStore struct{}
+
+func (nullStore) Load() (map[string]*SavedGame, error)                 { return nil, nil }
+func (nullStore) RecordJoin(string, int, uint32, string, string) error { return nil }
+func (nullStore) RecordNumPlayers(string, int) error                   { return nil }
+func (nullStore) RecordTurn(string, bool, uint32) error                { return nil }
+func (nullStore) RecordSecret(string, *SecretHash) error               { return nil }
+func (nullStore) RecordPublic(string) error                            { return nil }
+func (nullStore) RecordGameState(string, []byte) error                 { return nil }
+func (nullStore) RecordRemovePlayer(string, uint32) error              { return nil }
+func (nullStore) RecordRemoveGame(string) error                        { return nil }
+func (nullStore) Close() error                                         { return nil }
+
+// Kinds of log entries
+const (
+	logJoin         = "join"
+	logGameState    = "state"
+	logTurn         = "turn"
+	logSecret       = "secret"
+	logPublic       = "public"
+	logNumPlayers   = "numPlayers"
+	logRemovePlayer = "removePlayer"
+	logRemoveGame   = "removeGame"
+)
+
+// One entry in the append-only log
+type logEntry struct {
+	Kind         string      `json:"kind"`
+	GameToken    string      `json:"gameToken"`
+	NumPlayers   int         `json:"numPlayers,omitempty"`
+	PlayerOrder  uint32      `json:"playerOrder,omitempty"`
+	PlayerToken  string      `json:"playerToken,omitempty"`
+	Subject      string      `json:"subject,omitempty"`
+	GameState    []byte      `json:"gameState,omitempty"`
+	EnforceTurns bool        `json:"enforceTurns,omitempty"`
+	ActivePlayer uint32      `json:"activePlayer,omitempty"`
+	Secret       *SecretHash `json:"secret,omitempty"`
+}
+
+// File names used within the state directory
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+)
+
+// Size the log may reach before it is folded into a new snapshot
+const compactThreshold = 4 * 1024 * 1024
+
+// Size beyond which a log line cannot be a valid entry (an entry holds at most one encoded game state)
+const maxLogLineSize = 4 * maxMessageSize
+
+// A GameStore that keeps a snapshot file plus an append-only log of changes since the snapshot.
+// The current state is also kept in memory so that the log can be compacted without rereading it.
+type fileStore struct {
+	mu      sync.Mutex
+	dir     string
+	games   map[string]*SavedGame
+	log     *os.File
+	logSize int64
+}
+
+// Make a file store in the given directory, creating the directory if necessary
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, games: make(map[string]*SavedGame)}, nil
+}
+
+// Load reads the snapshot, applies the log, then writes a fresh snapshot and starts a new log
+func (s *fileStore) Load() (map[string]*SavedGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoded, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(encoded, &s.games); err != nil {
+			return nil, fmt.Errorf("corrupt snapshot: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := s.replayLog(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	ans := make(map[string]*SavedGame, len(s.games))
+	for gameToken, game := range s.games {
+		saved := *game
+		saved.Players = make(map[uint32]*SavedPlayer, len(game.Players))
+		for order, player := range game.Players {
+			savedPlayer := *player
+			saved.Players[order] = &savedPlayer
+		}
+		ans[gameToken] = &saved
+	}
+	return ans, nil
+}
+
+// Apply the entries of an existing log to the in-memory state.  Lines that cannot be entries, such as a
+// torn final line (from a crash mid-write), are logged and skipped.
+func (s *fileStore) replayLog() error {
+	file, err := os.Open(filepath.Join(s.dir, logFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.applyLine(line, lineNumber)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Apply one line of the log, skipping it if it is not a valid entry
+func (s *fileStore) applyLine(line []byte, lineNumber int) {
+	if len(line) > maxLogLineSize {
+		slog.Warn("Ignoring oversized log entry", "file", logFile, "line", lineNumber, "size", len(line))
+		return
+	}
+	var entry logEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		slog.Warn("Ignoring unreadable log entry", "file", logFile, "line", lineNumber, "error", err)
+		return
+	}
+	s.apply(&entry)
+}
+
+// Apply one log entry to the in-memory state
+func (s *fileStore) apply(entry *logEntry) {
+	game := s.games[entry.GameToken]
+	switch entry.Kind {
+	case logJoin:
+		if game == nil {
+			game = &SavedGame{Players: make(map[uint32]*SavedPlayer)}
+			s.games[entry.GameToken] = game
+		}
+		if game.NumPlayers == 0 {
+			game.NumPlayers = entry.NumPlayers
+		}
+		game.Players[entry.PlayerOrder] = &SavedPlayer{Token: entry.PlayerToken, Subject: entry.Subject}
+	case logNumPlayers:
+		if game != nil {
+			game.NumPlayers = entry.NumPlayers
+		}
+	case logTurn:
+		if game != nil {
+			game.EnforceTurns = entry.EnforceTurns
+			game.ActivePlayer = entry.ActivePlayer
+		}
+	case logSecret:
+		if game != nil {
+			game.Secret = entry.Secret
+		}
+	case logPublic:
+		if game != nil {
+			game.Public = true
+		}
+	case logGameState:
+		if game != nil {
+			game.GameState = entry.GameState
+		}
+	case logRemovePlayer:
+		if game != nil {
+			delete(game.Players, entry.PlayerOrder)
+		}
+	case logRemoveGame:
+		delete(s.games, entry.GameToken)
+	}
+}
+
+// Write the in-memory state as a new snapshot (atomically, via rename) and start an empty log
+func (s *fileStore) compact() error {
+	encoded, err := json.Marshal(s.games)
+	if err != nil {
+		return err
+	}
+	temp := filepath.Join(s.dir, snapshotFile+".tmp")
+	if err := os.WriteFile(temp, encoded, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, err = os.OpenFile(filepath.Join(s.dir, logFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	s.logSize = 0
+	return err
+}
+
+// Apply an entry to the in-memory state and append it to the log, compacting if the log has grown large
+func (s *fileStore) append(entry *logEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(entry)
+	if s.log == nil {
+		return errors.New("game store used before it was loaded")
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n, err := s.log.Write(append(encoded, '\n'))
+	s.logSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.logSize > compactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileStore) RecordJoin(gameToken string, numPlayers int, playerOrder uint32, playerToken string,
+	subject string) error {
+	return s.append(&logEntry{Kind: logJoin, GameToken: gameToken, NumPlayers: numPlayers,
+		PlayerOrder: playerOrder, PlayerToken: playerToken, Subject: subject})
+}
+
+func (s *fileStore) RecordNumPlayers(gameToken string, numPlayers int) error {
+	return s.append(&logEntry{Kind: logNumPlayers, GameToken: gameToken, NumPlayers: numPlayers})
+}
+
+func (s *fileStore) RecordTurn(gameToken string, enforceTurns bool, activePlayer uint32) error {
+	return s.append(&logEntry{Kind: logTurn, GameToken: gameToken, EnforceTurns: enforceTurns,
+		ActivePlayer: activePlayer})
+}
+
+func (s *fileStore) RecordSecret(gameToken string, secret *SecretHash) error {
+	return s.append(&logEntry{Kind: logSecret, GameToken: gameToken, Secret: secret})
+}
+
+func (s *fileStore) RecordPublic(gameToken string) error {
+	return s.append(&logEntry{Kind: logPublic, GameToken: gameToken})
+}
+
+func (s *fileStore) RecordGameState(gameToken string, state []byte) error {
+	return s.append(&logEntry{Kind: logGameState, GameToken: gameToken, GameState: state})
+}
+
+func (s *fileStore) RecordRemovePlayer(gameToken string, playerOrder uint32) error {
+	return s.append(&logEntry{Kind: logRemovePlayer, GameToken: gameToken, PlayerOrder: playerOrder})
+}
+
+func (s *fileStore) RecordRemoveGame(gameToken string) error {
+	return s.append(&logEntry{Kind: logRemoveGame, GameToken: gameToken})
+}
+
+// Close folds the log into the snapshot and closes the log file
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.compact()
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	return err
+}
+
+// A GameStore that records changes in a goroutine of its own, so that callers holding the registry lock
+// or running a hub never wait for the disk.  Changes are recorded in the order they are made, and any
+// error is logged rather than returned.  Close waits for the changes already made to be recorded.
+type queuedStore struct {
+	inner   GameStore
+	mu      sync.Mutex
+	ready   *sync.Cond     // Signaled when there are pending changes or the store is closed
+	pending []func() error // Changes not yet recorded
+	closed  bool
+	done    chan struct{} // Closed when the goroutine has recorded everything and exited
+}
+
+// Wrap a store so that its changes are recorded in the background
+func newQueuedStore(inner GameStore) *queuedStore {
+	s := &queuedStore{inner: inner, done: make(chan struct{})}
+	s.ready = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Record the pending changes until the store is closed
+func (s *queuedStore) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.closed {
+			s.ready.Wait()
+		}
+		batch := s.pending
+		s.pending = nil
+		closed := s.closed
+		s.mu.Unlock()
+		for _, record := range batch {
+			logStoreError(record())
+		}
+		if closed && len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// Queue a change to be recorded.  Changes made after Close are dropped.
+func (s *queuedStore) enqueue(record func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("game store used after it was closed")
+	}
+	s.pending = append(s.pending, record)
+	s.ready.Signal()
+	return nil
+}
+
+func (s *queuedStore) Load() (map[string]*SavedGame, error) {
+	return s.inner.Load()
+}
+
+func (s *queuedStore) RecordJoin(gameToken string, numPlayers int, playerOrder uint32, playerToken string,
+	subject string) error {
+	return s.enqueue(func() error {
+		return s.inner.RecordJoin(gameToken, numPlayers, playerOrder, playerToken, subject)
+	})
+}
+
+func (s *queuedStore) RecordNumPlayers(gameToken string, numPlayers int) error {
+	return s.enqueue(func() error { return s.inner.RecordNumPlayers(gameToken, numPlayers) })
+}
+
+func (s *queuedStore) RecordTurn(gameToken string, enforceTurns bool, activePlayer uint32) error {
+	return s.enqueue(func() error { return s.inner.RecordTurn(gameToken, enforceTurns, activePlayer) })
+}
+
+func (s *queuedStore) RecordSecret(gameToken string, secret *SecretHash) error {
+	return s.enqueue(func() error { return s.inner.RecordSecret(gameToken, secret) })
+}
+
+func (s *queuedStore) RecordPublic(gameToken string) error {
+	return s.enqueue(func() error { return s.inner.RecordPublic(gameToken) })
+}
+
+func (s *queuedStore) RecordGameState(gameToken string, state []byte) error {
+	return s.enqueue(func() error { return s.inner.RecordGameState(gameToken, state) })
+}
+
+func (s *queuedStore) RecordRemovePlayer(gameToken string, playerOrder uint32) error {
+	return s.enqueue(func() error { return s.inner.RecordRemovePlayer(gameToken, playerOrder) })
+}
+
+func (s *queuedStore) RecordRemoveGame(gameToken string) error {
+	return s.enqueue(func() error { return s.inner.RecordRemoveGame(gameToken) })
+}
+
+// Close records the pending changes, then closes the underlying store
+func (s *queuedStore) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.ready.Signal()
+	s.mu.Unlock()
+	<-s.done
+	return s.inner.Close()
+}
@@ -0,0 +1,157 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Load(); err != nil {
+		t.Fatal(err)
+	}
+	secret := newSecretHash("open sesame")
+	for _, err := range []error{
+		first.RecordJoin(testGame, 2, 1, alice, "alice"),
+		first.RecordSecret(testGame, secret),
+		first.RecordTurn(testGame, true, 1),
+		first.RecordJoin(testGame, 2, 2, bob, "bob"),
+		first.RecordGameState(testGame, []byte("state")),
+		first.RecordRemovePlayer(testGame, 2),
+		first.RecordJoin("tests_othergame", 3, 1, alice, "alice"),
+		first.RecordRemoveGame("tests_othergame"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reload without closing, as after a crash, so the log is replayed
+	defer first.log.Close()
+	second, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := second.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	game := saved[testGame]
+	if len(saved) != 1 || game == nil {
+		t.Fatalf("unexpected games %v", saved)
+	}
+	if game.NumPlayers != 2 || len(game.Players) != 1 || game.Players[1].Subject != "alice" ||
+		string(game.GameState) != "state" || !game.EnforceTurns || game.ActivePlayer != 1 {
+		t.Fatalf("unexpected game %+v", game)
+	}
+	if game.Secret == nil || !game.Secret.matches("open sesame") || game.Secret.matches("open barley") {
+		t.Fatal("secret not restored")
+	}
+}
+
+func TestFileStoreSkipsBadLogLines(t *testing.T) {
+	dir := t.TempDir()
+	good, _ := json.Marshal(&logEntry{Kind: logJoin, GameToken: testGame, NumPlayers: 2, PlayerOrder: 1,
+		PlayerToken: alice, Subject: "alice"})
+	oversized := `{"kind":"state","gameToken":"` + testGame + `","gameState":"` +
+		strings.Repeat("A", maxLogLineSize) + `"}`
+	contents := strings.Join([]string{"not json", oversized, string(good), `{"kind":"join","gameTok`}, "\n")
+	if err := os.WriteFile(filepath.Join(dir, logFile), []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	game := saved[testGame]
+	if len(saved) != 1 || game == nil || len(game.Players) != 1 || game.GameState != nil {
+		t.Fatalf("unexpected games %v", saved)
+	}
+}
+
+func TestQueuedStoreRecordsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	inner, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := newQueuedStore(inner)
+	if _, err := queued.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queued.RecordJoin(testGame, 2, 1, alice, "alice")
+	for i := 0; i < 100; i++ {
+		queued.RecordGameState(testGame, []byte(strconv.Itoa(i)))
+	}
+	if err := queued.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queued.RecordRemoveGame(testGame); err == nil {
+		t.Fatal("change accepted after close")
+	}
+
+	reloaded, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := reloaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if game := saved[testGame]; game == nil || string(game.GameState) != "99" {
+		t.Fatalf("unexpected games %v", saved)
+	}
+}
+
+func TestFileStoreLoadsSnapshotWithoutSubjects(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := `{"` + testGame + `":{"numPlayers":2,"players":{"1":"` + alice + `"},"gameState":"c3RhdGU="}}`
+	if err := os.WriteFile(filepath.Join(dir, snapshotFile), []byte(snapshot), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	game := saved[testGame]
+	if game == nil || game.Players[1] == nil || game.Players[1].Token != alice || game.Players[1].Subject != "" ||
+		string(game.GameState) != "state" {
+		t.Fatalf("unexpected games %v", saved)
+	}
+}
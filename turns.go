@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Server-side turn enforcement, for games created with the EnforceTurns option.  In such games only the
+// active player may send game states.  The turn passes when the active player sends an explicit turn
+// message or (in protocol v2) marks a game state with "endTurn".
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/exp/maps"
+)
+
+// Determine whether a player may send a game state.  Always true unless the game enforces turns.
+func (r *GameRegistry) mayUpdate(game *Game, playerOrder uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !game.EnforceTurns || game.ActivePlayer == playerOrder
+}
+
+// End the turn of a player.  The turn passes to `next` or, if next is 0, to the player with the next
+// higher order number (wrapping around to the lowest).  Returns the new active player.
+func (r *GameRegistry) endTurn(game *Game, playerOrder uint32, next uint32) (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !game.EnforceTurns {
+		return 0, errors.New("turns are not enforced in this game")
+	}
+	if game.ActivePlayer != playerOrder {
+		return 0, errors.New("it is not your turn")
+	}
+	if next == 0 {
+		next = nextPlayer(game, playerOrder)
+	} else if game.Players[next] == nil {
+		return 0, fmt.Errorf("there is no player %d", next)
+	}
+	game.ActivePlayer = next
+	logStoreError(store.RecordTurn(game.Hub.gameToken, true, next))
+	return next, nil
+}
+
+// Subroutine to find the player following a given one in order number order, wrapping around.
+// The registry lock must be held.
+func nextPlayer(game *Game, playerOrder uint32) uint32 {
+	orders := maps.Keys(game.Players)
+	slices.Sort(orders)
+	for _, order := range orders {
+		if order > playerOrder {
+			return order
+		}
+	}
+	if len(orders) == 0 {
+		return playerOrder
+	}
+	return orders[0]
+}
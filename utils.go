@@ -19,11 +19,14 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
@@ -36,7 +39,7 @@ import (
 func screenRequest(w http.ResponseWriter, r *http.Request) *map[string]interface{} {
 	uri := r.RequestURI
 	method := r.Method
-	fmt.Println("Got request", method, uri)
+	requestLogger(r).Info("Got request", "method", method, "uri", uri)
 	if method != http.MethodPost {
 		indicateError(http.StatusMethodNotAllowed, "forbidden method", w)
 		return nil
@@ -50,10 +53,14 @@ func screenRequest(w http.ResponseWriter, r *http.Request) *map[string]interface
 	return body
 }
 
+// Get the validated JWT claims of a request that has passed through EnsureValidToken
+func getClaims(r *http.Request) *validator.ValidatedClaims {
+	return r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+}
+
 // Special validator for admin requests
 func isAdmin(w http.ResponseWriter, r *http.Request) bool {
-	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
-	claims := token.CustomClaims.(*CustomClaims)
+	claims := getClaims(r).CustomClaims.(*CustomClaims)
 	if !claims.HasPermission("admin:server") {
 		indicateError(http.StatusForbidden, "You need to be an administrator to perform this operation.", w)
 		return false
@@ -71,6 +78,11 @@ func isValidGameToken(gameToken string) bool {
 	return len(gameToken) >= minGameTokenLen && regexp.MustCompile(`^[a-zA-Z0-9_-]*$`).MatchString(gameToken)
 }
 
+// Check validity of an appId: 5-15 characters consisting of lowercase alphabetics and hyphens
+func isValidAppId(appId string) bool {
+	return regexp.MustCompile(`^[a-z-]{5,15}$`).MatchString(appId)
+}
+
 // Check validity of player token.  The first part a base64 encoded player name, which is not checked.
 // The second part is an "order number" represented as a string of ascii digits.  Note that 0 is never
 // a valid player order number.  If valid, the order number is also returned.
@@ -86,14 +98,38 @@ func isValidPlayer(player string) (uint32, bool) {
 	return uint32(maybe), true
 }
 
+// Check validity of a spectator name: non-empty, not too long and without white space (it is not
+// otherwise interpreted).
+func isValidSpectator(name string) bool {
+	return len(name) <= maxSpectatorNameLen && regexp.MustCompile(`^\S+$`).MatchString(name)
+}
+
 // Function to indicate an error, both logging it to the server console and reflecting it back to
-// the client.
+// the client.  The log record carries the request id (if any) so it can be matched with the request.
 func indicateError(status int, msg string, w http.ResponseWriter) {
-	fmt.Println(msg + "!")
+	slog.Warn(msg, "status", status, logKeyRequestID, w.Header().Get(requestIDHeader))
 	w.WriteHeader(status)
 	w.Write(errorDictionary(msg))
 }
 
+// Like indicateError but also includes a stable error code (under the key "code") for the client to act on.
+func indicateCodedError(status int, code string, msg string, w http.ResponseWriter) {
+	slog.Warn(msg, "status", status, "code", code, logKeyRequestID, w.Header().Get(requestIDHeader))
+	w.WriteHeader(status)
+	w.Write(codedErrorDictionary(code, msg))
+}
+
+// The text of an error as shown to a client.  Go error strings start in lower case, but the messages the
+// server sends to clients are capitalized.
+func clientMessage(err error) string {
+	text := err.Error()
+	if text == "" {
+		return text
+	}
+	first, size := utf8.DecodeRuneInString(text)
+	return string(unicode.ToUpper(first)) + text[size:]
+}
+
 // Get a single-valued query value from an http.Request, returning empty string if not present or if there
 // are multiple values.
 func getQueryValue(r *http.Request, key string) string {
@@ -107,31 +143,12 @@ func getQueryValue(r *http.Request, key string) string {
 	return ans[0]
 }
 
-// Given game and player tokens that are syntactically valid but may or may not designate
-// and actual game and player, make sure that the game and player exist and return the
-// Game and Player structures.  A Game will always have a running Hub whether pre-existing or not.
-// A newly created Player may not yet have a Client.
-func ensureGameAndPlayer(gameToken string, playerToken string, playerOrder uint32,
-	numPlayers int) (*Game, *Player) {
-
-	game := games[gameToken]
-	if game == nil {
-		game = &Game{Players: make(map[uint32]*Player), Hub: newHub(), NumPlayers: numPlayers}
-		games[gameToken] = game
-		go game.Hub.run()
-		fmt.Printf("New game created with token %s\n", gameToken)
-	}
-	if game.NumPlayers == 0 {
-		fmt.Printf("Number of players in game %s set to %d\n", gameToken, numPlayers)
-		game.NumPlayers = numPlayers
-	} // TODO should we check for "too many leaders" here?
-	if game.Players[playerOrder] == nil {
-		game.Players[playerOrder] = &Player{Token: playerToken}
-		fmt.Printf("Player %d added to game %s\n", playerOrder, gameToken)
-	} else {
-		game.Players[playerOrder].IdleCount = 0
+// Get an environment variable, or a default if it is not set
+func getenvDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-	return game, game.Players[playerOrder]
+	return defaultValue
 }
 
 // Convert an error message to an error dictionary using the key "error".
@@ -140,3 +157,10 @@ func errorDictionary(msg string) []byte {
 	toSend, _ := json.Marshal(dict) // assume no error
 	return toSend
 }
+
+// Convert an error message and error code to an error dictionary using the keys "error" and "code".
+func codedErrorDictionary(code string, msg string) []byte {
+	dict := map[string]string{"error": msg, "code": code}
+	toSend, _ := json.Marshal(dict) // assume no error
+	return toSend
+}
@@ -25,10 +25,10 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-
+	"log/slog"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -38,12 +38,6 @@ const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 30 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer.
 	// TODO this is big enough to hold the JSON encoding of double-deck game state.  A considerably smaller
 	// value would work if we switched to a dense binary encoding, but that is a bunch of work requiring
@@ -62,6 +56,7 @@ var (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{subprotocolV2, subprotocolV1},
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -72,33 +67,99 @@ type Client struct {
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan *Message
+
+	// The protocol version negotiated for this connection (protocolV1 or protocolV2).
+	protocol int
 
 	// Termination indicator.  All goroutines should exit when they see this
 	// and the main logic should not use the Client but rather create a new one.
-	terminated bool
+	// Atomic because Destroy may be called from the pumps and from cleanup concurrently.
+	terminated atomic.Bool
 
-	// Address of Player structure whose idle count can be reset on pong responses
+	// Address of Player structure whose idle count can be reset on pong responses.  Nil for a spectator.
 	player *Player
+
+	// The name of a spectator (empty for a player) and whether the spectator takes part in chat
+	spectator string
+	chat      bool
+
+	// The player's order number, used to route targeted messages
+	order uint32
+
+	// For a player resuming a session, the sequence number of the last message it acknowledged
+	resumeAfter *uint64
+
+	// The game the player belongs to
+	game *Game
+
+	// Logger carrying the game, player and originating request of this client
+	log *slog.Logger
 }
 
 // Destroy closes out all goroutines of this client, closes the connection, stops the ticker, will exit, the connection is closed, the hub
 // is notified with "deregister" and the destruction is recorded
 func (c *Client) Destroy() {
-	if c.terminated {
+	if !c.terminated.CompareAndSwap(false, true) {
 		// Don't do this multiple times
 		return
 	}
-	c.terminated = true
 	// Unregister from the hub _before_ sending the lost player message so as not to try sending
 	// it to the lost player itself.
-	c.hub.unregister <- c
-	fmt.Printf("Sending lost player message for player %s\n", c.player.Token)
-	c.hub.broadcastMessage(lostPlayerType, []byte(c.player.Token))
+	c.hub.unregisterClient(c)
+	// During shutdown, the players are not lost; everyone has been told the server is going away.
+	// Spectators are never reported as lost.  A player that may still reconnect is only reported as
+	// disconnected (see reconnect.go), and one that already has a new client is not reported at all.
+	if !shuttingDown.Load() && !c.isSpectator() {
+		switch registry.disconnect(c) {
+		case playerDisconnected:
+			c.log.Info("Sending disconnected player message")
+			c.hub.broadcastMessage(disconnectedType, []byte(c.player.Token))
+		case playerLost:
+			c.log.Info("Sending lost player message")
+			c.hub.broadcastMessage(lostPlayerType, []byte(c.player.Token))
+			if leader, elected := registry.leaderLost(c.game, c); elected {
+				c.hub.announceLeader(leader)
+			}
+		}
+	}
 	// TODO should this always be an abrupt close?
 	c.conn.Close()
 }
 
+// Whether the client is a spectator rather than a player
+func (c *Client) isSpectator() bool {
+	return c.player == nil
+}
+
+// The name identifying the client as a sender: the player token, or the spectator name
+func (c *Client) name() string {
+	if c.isSpectator() {
+		return c.spectator
+	}
+	return c.player.Token
+}
+
+// Whether a message broadcast to the game should be delivered to the client.  Spectators only see game
+// states, player lists, lost players and server announcements, plus chat if they asked for it.  V1 clients
+// are not sent the v2-only types (see protocol.go).
+func (c *Client) accepts(msgType byte) bool {
+	if c.protocol == protocolV1 && isV2Only(msgType) {
+		return false
+	}
+	if !c.isSpectator() {
+		return true
+	}
+	switch msgType {
+	case gameStateType, playerListType, lostPlayerType, goingAwayType, startedType, endedType, leaderType,
+		disconnectedType, reconnectedType:
+		return true
+	case chatType:
+		return c.chat
+	}
+	return false
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
@@ -109,38 +170,105 @@ func (c *Client) readPump() {
 		c.Destroy()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(config.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		fmt.Printf("Pong message received.  Resetting idle count for player %s\n", c.player.Token)
-		c.player.IdleCount = 0
+		c.conn.SetReadDeadline(time.Now().Add(config.PongWait))
+		if !c.isSpectator() {
+			c.log.Debug("Pong message received.  Resetting idle count")
+			registry.markActive(c.player)
+		}
 		return nil
 	})
 	for {
-		if c.terminated {
+		if c.terminated.Load() {
 			return
 		}
 		_, buffer, err := c.conn.ReadMessage()
 		if err != nil {
 			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				fmt.Printf("error: %v\n", err)
+				c.log.Warn("Error reading from websocket", "error", err)
 			}
-			fmt.Printf("Closing connection for player %s\n", c.player.Token)
+			c.log.Info("Closing connection")
+			return
+		}
+		bytesIn.Add(uint64(len(buffer)))
+		message, err := decodeMessage(c.protocol, buffer)
+		if err != nil {
+			c.log.Warn("Malformed incoming message.  Closing connection", "error", err)
 			return
 		}
-		msgType := buffer[0]
-		if msgType == chatType {
+		msgType := message.Type
+		if c.isSpectator() && !(msgType == chatType && c.chat) {
+			c.log.Info("Rejecting message from spectator", "type", string(rune(msgType)))
+			c.hub.sendError(c, "Spectators may not send this message")
+			continue
+		}
+		switch msgType {
+		case chatType:
 			// For chat, clean up the message a bit as it is supposed to be text
-			buffer = bytes.TrimSpace(bytes.Replace(buffer, newline, space, -1))
-		} else if msgType != gameStateType {
-			fmt.Printf("Unexpected incoming message type %d\n", msgType)
-			fmt.Printf("Closing connection for player %s\n", c.player.Token)
+			message.Body = bytes.TrimSpace(bytes.Replace(message.Body, newline, space, -1))
+		case gameStateType:
+			if !registry.mayUpdate(c.game, c.order) {
+				c.log.Info("Rejecting out of turn game state")
+				c.hub.sendError(c, "It is not your turn")
+				continue
+			}
+		case targetedType:
+		case turnType:
+			c.endTurn(message.Body)
+			continue
+		case endedType:
+			if !registry.isLeader(c.game, c) {
+				c.log.Info("Rejecting end of game from a player who is not the leader")
+				c.hub.sendError(c, "Only the leader may end the game")
+				continue
+			}
+			c.log.Info("Player ended the game")
+			registry.endGame(c.hub.gameToken, phaseFinished)
+			continue
+		case ackType:
+			seq, err := strconv.ParseUint(string(message.Body), 10, 64)
+			if err != nil {
+				c.hub.sendError(c, "Invalid acknowledgement")
+				continue
+			}
+			registry.acknowledge(c.player, seq)
+			continue
+		default:
+			c.log.Warn("Unexpected incoming message type.  Closing connection", "type", string(rune(msgType)))
+			return
+		}
+		c.log.Debug("Valid message received.  Broadcasting", "type", string(rune(msgType)))
+		// For each valid message type just echo it to everyone (or to the recipients, for targeted messages)
+		message.Sender = c.name()
+		message.origin = c
+		c.hub.relay(message)
+		if message.EndTurn {
+			c.endTurn(nil)
+		}
+	}
+}
+
+// Handle the end of this client's turn.  The body is empty or the order number of the next player.
+// On success the new active player is announced to everyone; otherwise the error is reported to this client.
+func (c *Client) endTurn(body []byte) {
+	var next uint64
+	if len(body) > 0 {
+		var err error
+		next, err = strconv.ParseUint(string(body), 10, 32)
+		if err != nil {
+			c.hub.sendError(c, "Invalid next player")
 			return
 		}
-		fmt.Printf("Valid message received of type %d from player %s.  Broadcasting.\n", msgType, c.player.Token)
-		// For each valid message type just echo it to everyone
-		c.hub.broadcast <- buffer
 	}
+	active, err := registry.endTurn(c.game, c.order, uint32(next))
+	if err != nil {
+		c.hub.sendError(c, clientMessage(err))
+		return
+	}
+	c.log.Info("Player ended turn", "active", active)
+	c.hub.relay(&Message{Type: turnType, Body: []byte(strconv.FormatUint(uint64(active), 10)),
+		Sender: c.player.Token})
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -149,13 +277,13 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(config.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.Destroy()
 	}()
 	for {
-		if c.terminated {
+		if c.terminated.Load() {
 			return
 		}
 		select {
@@ -163,22 +291,35 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMessage := []byte{}
+				if shuttingDown.Load() {
+					closeMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
 
-			writerType := websocket.BinaryMessage
-			if message[0] == chatType {
-				writerType = websocket.TextMessage
-			}
+			writerType, data := encodeMessage(c.protocol, message)
 			w, err := c.conn.NextWriter(writerType)
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(data)
+			bytesOut.Add(uint64(len(data)))
 			if err := w.Close(); err != nil {
 				return
 			}
+			// Server announcements that end the connection
+			switch message.Type {
+			case goingAwayType:
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, goingAwayReason))
+				return
+			case endedType:
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "game "+string(message.Body)))
+				return
+			}
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -196,7 +337,22 @@ func newWebSocket(w http.ResponseWriter, r *http.Request) {
 	playerToken := getQueryValue(r, playerKey)
 	gameToken := getQueryValue(r, gameTokenKey)
 	numPlayersString := getQueryValue(r, numPlayersKey)
-	fmt.Printf("newWebsocket: playerToken=%s and game=%s\n", playerToken, gameToken)
+	enforceTurnsString := getQueryValue(r, enforceTurnsKey)
+	publicString := getQueryValue(r, publicKey)
+	log := requestLogger(r).With(logKeyGameToken, gameToken, logKeyPlayer, playerToken)
+	log.Info("newWebsocket")
+	if shuttingDown.Load() {
+		indicateError(http.StatusServiceUnavailable, "Server is shutting down", w)
+		return
+	}
+	if spectator := getQueryValue(r, spectatorKey); spectator != "" {
+		newSpectatorSocket(w, r, gameToken, spectator, log)
+		return
+	}
+	if resumeToken := getQueryValue(r, resumeTokenKey); resumeToken != "" {
+		resumeWebSocket(w, r, resumeToken)
+		return
+	}
 	if playerToken == "" || gameToken == "" {
 		indicateError(http.StatusBadRequest, "Missing required header information for websocket", w)
 		return
@@ -213,38 +369,129 @@ func newWebSocket(w http.ResponseWriter, r *http.Request) {
 	numPlayers := 0
 	if numPlayersString != "" {
 		maybe, err := strconv.Atoi(numPlayersString)
-		if err != nil {
+		if err != nil || maybe < 0 {
 			indicateError(http.StatusBadRequest, "Invalid value for numPlayers", w)
 			return
 		}
 		numPlayers = maybe
 	}
+	options := GameOptions{Secret: getQueryValue(r, secretKey)}
+	if enforceTurnsString != "" {
+		maybe, err := strconv.ParseBool(enforceTurnsString)
+		if err != nil {
+			indicateError(http.StatusBadRequest, "Invalid value for enforceTurns", w)
+			return
+		}
+		options.EnforceTurns = maybe
+	}
+	if publicString != "" {
+		maybe, err := strconv.ParseBool(publicString)
+		if err != nil {
+			indicateError(http.StatusBadRequest, "Invalid value for public", w)
+			return
+		}
+		options.Public = maybe
+	}
+	// Find or create the game and player, checking that the player belongs to this user
+	subject := getClaims(r).RegisteredClaims.Subject
+	game, player, err := registry.ensureGameAndPlayer(gameToken, playerToken, playerOrder, numPlayers, subject,
+		options)
+	if err != nil {
+		joinErr := err.(*joinError)
+		indicateCodedError(joinErr.status, joinErr.code, joinErr.msg, w)
+		return
+	}
+	openPlayerSocket(w, r, game, player, playerOrder, nil, log)
+}
+
+// Open the websocket of a player that has been admitted to a game.  For a player resuming a session,
+// resumeAfter is the sequence number of the last message it acknowledged.
+func openPlayerSocket(w http.ResponseWriter, r *http.Request, game *Game, player *Player, playerOrder uint32,
+	resumeAfter *uint64, log *slog.Logger) {
 	// We have valid inputs so it's ok to upgrade
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
+		log.Warn("Websocket upgrade failed", "error", err)
 		return
 	}
-	fmt.Println("Websocket upgrade completed")
+	log.Info("Websocket upgrade completed", "protocol", protocolVersion(conn))
 	// Create and remember Client
-	game, player := ensureGameAndPlayer(gameToken, playerToken, playerOrder, numPlayers)
-	if player.Client != nil {
+	client := &Client{hub: game.Hub, conn: conn, send: make(chan *Message, sentFrameSize), player: player,
+		protocol: protocolVersion(conn), order: playerOrder, resumeAfter: resumeAfter, game: game, log: log}
+	old, resumed := registry.attachClient(player, client)
+	if old != nil {
 		// Make sure old client is dead if found
-		player.Client.Destroy()
+		old.Destroy()
+	}
+	game.Hub.registerClient(client)
+	if client.accepts(resumeTokenType) {
+		resumeToken := newResumeToken(game.Hub.gameToken, player.Token, getClaims(r).RegisteredClaims.Subject)
+		game.Hub.sendTo(client, resumeTokenType, []byte(resumeToken))
 	}
-	player.Client = &Client{hub: game.Hub, conn: conn, send: make(chan []byte, sentFrameSize), player: player}
-	game.Hub.register <- player.Client
-	player.IdleCount = 0
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
-	go player.Client.writePump()
-	go player.Client.readPump()
+	go client.writePump()
+	go client.readPump()
 
-	fmt.Printf("New client added with order %d and token %s\n", playerOrder, playerToken)
+	log.Info("New client added")
 
-	// Notify all clients of the new player list
-	newPlayerList := makePlayerList(game)
-	fmt.Printf("Sending player list to all clients: %s\n", newPlayerList)
-	game.Hub.broadcastMessage(playerListType, []byte(newPlayerList))
+	if resumed {
+		// The player list is unchanged, so only the returning player needs it
+		log.Info("Player reconnected within its grace period")
+		game.Hub.sendTo(client, playerListType, []byte(registry.playerList(game)))
+		game.Hub.broadcastMessage(reconnectedType, []byte(player.Token))
+	} else {
+		// Notify all clients of the new player list
+		newPlayerList := registry.playerList(game)
+		log.Info("Sending player list to all clients", "list", newPlayerList)
+		game.Hub.broadcastMessage(playerListType, []byte(newPlayerList))
+	}
+	if leader, changed := registry.claimLeadership(game, client); changed {
+		log.Info("Player is the leader")
+		game.Hub.announceLeader(leader)
+	}
+	registry.startIfComplete(game)
+}
+
+// Open a websocket for a spectator of an existing game.  Spectators are not players: they do not
+// appear in the player list and do not count toward the number of players.
+func newSpectatorSocket(w http.ResponseWriter, r *http.Request, gameToken string, spectator string,
+	log *slog.Logger) {
+	log = log.With(logKeySpectator, spectator)
+	if !isValidGameToken(gameToken) {
+		indicateError(http.StatusBadRequest, "Game token is invalid", w)
+		return
+	}
+	if !isValidSpectator(spectator) {
+		indicateError(http.StatusBadRequest, "Spectator name is invalid", w)
+		return
+	}
+	chat := false
+	if chatString := getQueryValue(r, spectatorChatKey); chatString != "" {
+		maybe, err := strconv.ParseBool(chatString)
+		if err != nil {
+			indicateError(http.StatusBadRequest, "Invalid value for chat", w)
+			return
+		}
+		chat = maybe
+	}
+	subject := getClaims(r).RegisteredClaims.Subject
+	game, err := registry.admitSpectator(gameToken, subject, getQueryValue(r, secretKey))
+	if err != nil {
+		joinErr := err.(*joinError)
+		indicateCodedError(joinErr.status, joinErr.code, joinErr.msg, w)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("Websocket upgrade failed", "error", err)
+		return
+	}
+	log.Info("Spectator websocket upgrade completed", "protocol", protocolVersion(conn), "chat", chat)
+	client := &Client{hub: game.Hub, conn: conn, send: make(chan *Message, sentFrameSize),
+		protocol: protocolVersion(conn), spectator: spectator, chat: chat, game: game, log: log}
+	game.Hub.registerClient(client)
+	go client.writePump()
+	go client.readPump()
 }
@@ -23,64 +23,264 @@
 
 package main
 
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	// The token of the game served by this hub.
+	gameToken string
+
 	// Registered clients.
 	clients map[*Client]bool
 
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	broadcast chan *Message
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Closed by stop to ask the run loop to terminate.  Once closed, sends to the hub
+	// are abandoned rather than blocking.
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// Closed by the run loop when it has terminated.
+	done chan struct{}
+
+	// The most recent game state message and the most recent chat messages, replayed to each
+	// client as it registers so that (re)joining players can resume.  Owned by the run loop.
+	lastGameState *Message
+	recentChat    []*Message
+
+	// The announcement that the game has started, if it has, and the announcement of the current
+	// leader, if any.  Owned by the run loop.
+	started *Message
+	leader  *Message
+
+	// The sequence number of the last message broadcast.  Owned by the run loop.
+	seq uint64
+
+	// The most recent messages broadcast, the message with sequence number seq at index seq modulo the
+	// length.  Owned by the run loop.
+	history []*Message
 }
 
-func newHub() *Hub {
+func newHub(gameToken string) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		gameToken:  gameToken,
+		broadcast:  make(chan *Message),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		history:    make([]*Message, resumeHistorySize),
 	}
 }
 
 // Message types
-const gameStateType = 'G'  // Indicates a game state message
-const playerListType = 'P' // Indicates a player list message
-const lostPlayerType = 'L' // Indicates a lost player message
-const chatType = 'C'       // Indicates a chat message
+const gameStateType = 'G'    // Indicates a game state message
+const playerListType = 'P'   // Indicates a player list message
+const lostPlayerType = 'L'   // Indicates a lost player message
+const chatType = 'C'         // Indicates a chat message
+const targetedType = 'T'     // Indicates a message for specific players only
+const errorType = 'E'        // Indicates an error report sent to one client only
+const turnType = 'N'         // Ends a turn (from a client) or announces the active player (from the server)
+const goingAwayType = 'X'    // Announces that the server is shutting down; the last message before the close
+const startedType = 'S'      // Announces that the game has all its players and has started
+const endedType = 'F'        // Ends the game (from a client) or announces how it ended (from the server)
+const leaderType = 'H'       // Announces the order number of a new leader
+const disconnectedType = 'D' // Announces that a player has lost its connection but may still reconnect
+const reconnectedType = 'R'  // Announces that a disconnected player has reconnected
+const resumeTokenType = 'I'  // Gives a player the token with which it can resume its session
+const ackType = 'K'          // Acknowledges the messages up to a sequence number (from a client)
 
-// Send a message (other than chat) to all the clients
-// Chat is handled specially within the readPump when an incoming chat message is detected
+// Send a message originated by the server to all the clients
 func (h *Hub) broadcastMessage(msgType byte, body []byte) {
-	toSend := []byte{msgType}
-	toSend = append(toSend, body...)
-	h.broadcast <- toSend
+	h.relay(&Message{Type: msgType, Body: body})
+}
+
+// Send a message to all the clients.  Does nothing if the hub has stopped.
+func (h *Hub) relay(message *Message) {
+	select {
+	case h.broadcast <- message:
+	case <-h.quit:
+	}
+}
+
+// Send a message originated by the server to one client only.  Does nothing if the hub has stopped or
+// the client is no longer registered.
+func (h *Hub) sendTo(client *Client, msgType byte, body []byte) {
+	h.relay(&Message{Type: msgType, Body: body, only: client})
+}
+
+// Report an error to one client only
+func (h *Hub) sendError(client *Client, text string) {
+	h.sendTo(client, errorType, []byte(text))
+}
+
+// Register a client with the hub.  If the hub has stopped, the client's send channel is closed
+// instead, so that its writePump terminates.
+func (h *Hub) registerClient(client *Client) {
+	select {
+	case h.register <- client:
+	case <-h.quit:
+		close(client.send)
+	}
+}
+
+// Unregister a client from the hub.  Does nothing if the hub has stopped (in which case the client's
+// send channel was already closed).
+func (h *Hub) unregisterClient(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.quit:
+	}
+}
+
+// Stop the hub, closing the send channels of all registered clients, and wait for the run loop to
+// terminate.  Safe to call more than once.
+func (h *Hub) stop() {
+	h.stopOnce.Do(func() {
+		close(h.quit)
+	})
+	<-h.done
+}
+
+// Remember a message if it is of a kind that should be replayed to clients that register later
+func (h *Hub) remember(message *Message) {
+	switch message.Type {
+	case gameStateType:
+		h.lastGameState = message
+		logStoreError(store.RecordGameState(h.gameToken, message.Body))
+	case startedType:
+		h.started = message
+	case leaderType:
+		h.leader = message
+	case chatType:
+		h.recentChat = append(h.recentChat, message)
+		if len(h.recentChat) > chatReplayCount {
+			h.recentChat = h.recentChat[len(h.recentChat)-chatReplayCount:]
+		}
+	}
+}
+
+// Send the remembered game state, recent chat and announcements to a newly registered client
+func (h *Hub) replay(client *Client) {
+	var toSend []*Message
+	if h.lastGameState != nil {
+		toSend = append(toSend, h.lastGameState)
+	}
+	toSend = append(toSend, h.recentChat...)
+	if h.started != nil {
+		toSend = append(toSend, h.started)
+	}
+	if h.leader != nil {
+		toSend = append(toSend, h.leader)
+	}
+	for _, message := range toSend {
+		if !client.accepts(message.Type) {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			// Can only happen if the send buffer is tiny; the client will get the next broadcast anyway
+			return
+		}
+	}
 }
 
 func (h *Hub) run() {
+	defer close(h.done)
 	for {
 		select {
+		case <-h.quit:
+			for client := range h.clients {
+				h.drop(client)
+			}
+			return
 		case client := <-h.register:
 			h.clients[client] = true
+			connectedClients.Add(1)
+			if client.resumeAfter == nil || !h.resend(client, *client.resumeAfter) {
+				h.replay(client)
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.drop(client)
 			}
 		case message := <-h.broadcast:
+			if message.only != nil {
+				if h.clients[message.only] {
+					h.deliver(message.only, message)
+				}
+				continue
+			}
+			h.seq++
+			message.Seq = h.seq
+			message.Time = clock.Now()
+			h.history[h.seq%uint64(len(h.history))] = message
+			messagesRelayed[message.Type].Add(1)
+			if message.Recipients != nil {
+				h.route(message)
+				continue
+			}
+			h.remember(message)
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if client.accepts(message.Type) {
+					h.deliver(client, message)
 				}
 			}
 		}
 	}
 }
+
+// Queue a message for one client.  A client whose send buffer is full is dropped.
+func (h *Hub) deliver(client *Client, message *Message) {
+	select {
+	case client.send <- message:
+	default:
+		sendOverflows.Add(1)
+		h.drop(client)
+	}
+}
+
+// Remove a registered client, closing its send channel
+func (h *Hub) drop(client *Client) {
+	close(client.send)
+	delete(h.clients, client)
+	connectedClients.Add(-1)
+}
+
+// Deliver a targeted message to the clients of its recipients.  Recipients that have no client
+// are reported back to the sender.
+func (h *Hub) route(message *Message) {
+	found := make(map[uint32]bool)
+	for client := range h.clients {
+		if !client.isSpectator() && slices.Contains(message.Recipients, client.order) {
+			found[client.order] = true
+			h.deliver(client, message)
+		}
+	}
+	var unknown []string
+	for _, recipient := range message.Recipients {
+		if !found[recipient] {
+			unknown = append(unknown, strconv.FormatUint(uint64(recipient), 10))
+		}
+	}
+	if len(unknown) > 0 && message.origin != nil && h.clients[message.origin] {
+		h.deliver(message.origin, &Message{Type: errorType,
+			Body: []byte(fmt.Sprintf("unknown recipients: %s", strings.Join(unknown, ",")))})
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestHubStopClosesClientsAndExits(t *testing.T) {
+	base := runtime.NumGoroutine()
+	hub := newHub(testGame)
+	go hub.run()
+	clients := []*Client{{send: make(chan *Message, 1)}, {send: make(chan *Message, 1)}}
+	for _, client := range clients {
+		hub.registerClient(client)
+	}
+	hub.stop()
+	for _, client := range clients {
+		if _, open := <-client.send; open {
+			t.Fatal("client send channel not closed")
+		}
+	}
+	waitForGoroutines(t, base)
+
+	// Once stopped, the hub abandons sends rather than blocking, and stopping again is harmless
+	hub.broadcastMessage(chatType, []byte("hello"))
+	late := &Client{send: make(chan *Message, 1)}
+	hub.registerClient(late)
+	if _, open := <-late.send; open {
+		t.Fatal("client registered after stop not closed")
+	}
+	hub.stop()
+}
+
+func TestDeletedGamesReleaseGoroutines(t *testing.T) {
+	base := runtime.NumGoroutine()
+	registry.mu.Lock()
+	for i := 0; i < 10; i++ {
+		registry.addGame(fmt.Sprintf("%s%d", testGame, i), 2, GameOptions{})
+	}
+	registry.mu.Unlock()
+	if runtime.NumGoroutine() < base+10 {
+		t.Fatal("hubs not running")
+	}
+	registry.reset()
+	waitForGoroutines(t, base)
+}